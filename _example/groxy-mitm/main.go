@@ -4,25 +4,27 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 
 	"github.com/agatan/groxy"
 )
 
-func logging(h groxy.Handler) groxy.Handler {
-	return func(req *http.Request) (*http.Response, error) {
-		resp, err := h(req)
-		if err != nil {
-			return nil, err
-		}
-		fmt.Printf("%#v\n", resp)
-		return resp, nil
-	}
-}
-
 func main() {
 	var proxy groxy.ProxyServer
 	proxy.HTTPSAction = groxy.HTTPSActionMITM
-	proxy.Use(logging)
+	recorder := &groxy.Recorder{Dir: "har"}
+	proxy.Use(recorder.Middleware())
+
+	// write recorded entries before exit.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		if err := recorder.Flush(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(0)
+	}()
 
 	if err := http.ListenAndServe(":8888", &proxy); err != nil {
 		fmt.Fprintln(os.Stderr, err)
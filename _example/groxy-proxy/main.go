@@ -16,7 +16,7 @@ func (logger) Print(args ...interface{}) {
 }
 
 func main() {
-	proxy := groxy.New()
+	proxy := &groxy.ProxyServer{}
 	proxy.Logger = logger{}
 	if err := http.ListenAndServe(":8888", proxy); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -0,0 +1,94 @@
+package groxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseCIDRs parses networks in CIDR notation. Plain IP addresses are treated as single-host networks.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP address: %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL restricts clients allowed to use the proxy by their IP addresses.
+type ACL struct {
+	// Allow lists networks of permitted clients. If it's empty, all clients not denied are permitted.
+	Allow []*net.IPNet
+	// Deny lists networks of rejected clients. It takes precedence over Allow.
+	Deny []*net.IPNet
+}
+
+// NewACL creates an ACL from networks in CIDR notation.
+func NewACL(allow, deny []string) (*ACL, error) {
+	a := &ACL{}
+	var err error
+	if a.Allow, err = ParseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if a.Deny, err = ParseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Permits reports whether the client at ip is allowed to use the proxy.
+func (a *ACL) Permits(ip net.IP) bool {
+	if containsIP(a.Deny, ip) {
+		return false
+	}
+	return len(a.Allow) == 0 || containsIP(a.Allow, ip)
+}
+
+// remoteIP returns the IP address of the client that sent r, or nil if it's unknown.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func (p *ProxyServer) permitsClient(w http.ResponseWriter, r *http.Request) bool {
+	acl := p.current().clientACL
+	if acl == nil {
+		return true
+	}
+	if ip := remoteIP(r); ip != nil && acl.Permits(ip) {
+		return true
+	}
+	p.log("rejected client: ", r.RemoteAddr)
+	http.Error(w, "client is not allowed to use the proxy", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,69 @@
+package groxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestACLPermits(t *testing.T) {
+	acl, err := NewACL([]string{"10.0.0.0/8", "192.168.1.10"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatalf("failed to create ACL: %v", err)
+	}
+	cases := []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.2.3", false},
+		{"192.168.1.10", true},
+		{"192.168.1.11", false},
+		{"127.0.0.1", false},
+	}
+	for _, c := range cases {
+		if got := acl.Permits(net.ParseIP(c.ip)); got != c.expected {
+			t.Errorf("expected Permits(%s) is %v, but got %v", c.ip, c.expected, got)
+		}
+	}
+
+	if _, err := NewACL([]string{"not a network"}, nil); err == nil {
+		t.Errorf("expected invalid networks are rejected, but no error occurred")
+	}
+}
+
+func TestRejectClientByACL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	var proxy ProxyServer
+	acl, err := NewACL(nil, []string{"127.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.ClientACL = acl
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status code is %v, but got %v", http.StatusForbidden, resp.StatusCode)
+	}
+
+	conn, resp := connect(t, proxyserver, ts.Listener.Addr().String())
+	conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status code of CONNECT is %v, but got %v", http.StatusForbidden, resp.StatusCode)
+	}
+}
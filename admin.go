@@ -0,0 +1,401 @@
+package groxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin is an http.Handler of the JSON API to inspect and control a ProxyServer.
+// Set it to ProxyServer.NonProxyRequestHandler to serve it on the same port as the proxy:
+//
+//	admin := &groxy.Admin{Proxy: p, Recorder: recorder}
+//	p.NonProxyRequestHandler = admin
+//
+// It also serves a web UI to browse flows at "/". Endpoints of the API are:
+//
+//	GET    /api/flows            recent flows recorded by Recorder, as HAR entries (?limit=N for the latest N)
+//	GET    /api/flows.har        recent flows as a HAR file
+//	DELETE /api/flows            clears recent flows
+//	GET    /api/events           server-sent events of flows recorded from now on, as "flow" events
+//	GET    /api/connections      active tunnels and MITM sessions
+//	DELETE /api/connections/{id} closes the tunnel or MITM session
+//	GET    /api/config           current settings
+//	PUT    /api/https            changes HTTPSAction by {"action": "proxy" | "reject" | "mitm"}
+//	DELETE /api/caches           closes idle upstream connections and resets Replayer
+//	*      /api/intercept/...    Interceptor.Handler
+//
+// The API can control the proxy, so clients must send Token, or be on the loopback interface if Token is empty.
+// Requests changing anything must have "Content-Type: application/json" and must not be cross-origin,
+// so that web pages cannot send them from browsers.
+type Admin struct {
+	// Proxy is the ProxyServer to control.
+	Proxy *ProxyServer
+	// Recorder provides recent flows. If it's nil, Loader.Recorder() is used if Loader is set.
+	Recorder *Recorder
+	// Interceptor is operated under /api/intercept/. If it's nil, the endpoints are not available.
+	Interceptor *Interceptor
+	// Loader provides the current config. It's optional.
+	Loader *ConfigLoader
+	// Replayer is reset by DELETE /api/caches. It's optional.
+	Replayer *Replayer
+	// Token authenticates clients. They send it in "Authorization: Bearer" header,
+	// or open the web UI with "?token=" once, which stores it in a cookie.
+	// If it's empty, only requests from and to loopback addresses are allowed.
+	Token string
+
+	once sync.Once
+	mux  *http.ServeMux
+}
+
+func (a *Admin) recorder() *Recorder {
+	if a.Recorder != nil {
+		return a.Recorder
+	}
+	if a.Loader != nil {
+		return a.Loader.Recorder()
+	}
+	return nil
+}
+
+const adminTokenCookie = "groxy_admin_token"
+
+// isLoopbackHost reports whether host (with or without port) is a loopback address or localhost.
+// Host headers are checked in addition to client addresses, so that DNS rebinding cannot reach the API.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeHost(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+func (a *Admin) authenticated(r *http.Request) bool {
+	if a.Token == "" {
+		ip := remoteIP(r)
+		return ip != nil && ip.IsLoopback() && isLoopbackHost(r.Host)
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return secureCompare(token, a.Token)
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return secureCompare(strings.TrimSpace(auth[7:]), a.Token)
+	}
+	if c, err := r.Cookie(adminTokenCookie); err == nil {
+		return secureCompare(c.Value, a.Token)
+	}
+	return false
+}
+
+// sameOrigin reports whether r is not sent by browsers from other origins.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// authorize checks the client of r, and writes an error response if it's not allowed.
+func (a *Admin) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if !a.authenticated(r) {
+		if a.Token == "" {
+			writeJSONError(w, http.StatusForbidden, "the admin API is available only on localhost")
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="groxy"`)
+			writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+		}
+		return false
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return true
+	}
+	if !sameOrigin(r) {
+		writeJSONError(w, http.StatusForbidden, "cross-origin requests are not allowed")
+		return false
+	}
+	if r.Method == "POST" || r.Method == "PUT" {
+		if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+			writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+	if token := r.URL.Query().Get("token"); token != "" && r.URL.Path == "/" {
+		// the token is moved to a cookie, so that it's not left in the address bar and the history.
+		http.SetCookie(w, &http.Cookie{Name: adminTokenCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	a.once.Do(func() {
+		a.mux = http.NewServeMux()
+		a.mux.HandleFunc("/api/flows", a.serveFlows)
+		a.mux.HandleFunc("/api/flows.har", a.serveHAR)
+		a.mux.HandleFunc("/api/events", a.serveEvents)
+		a.mux.HandleFunc("/api/connections", a.serveConnections)
+		a.mux.HandleFunc("/api/connections/", a.serveConnection)
+		a.mux.HandleFunc("/api/config", a.serveConfig)
+		a.mux.HandleFunc("/api/https", a.serveHTTPS)
+		a.mux.HandleFunc("/api/caches", a.serveCaches)
+		a.mux.HandleFunc("/api/intercept/", a.serveIntercept)
+		a.mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+			writeJSONError(w, http.StatusNotFound, "not found")
+		})
+		a.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			serveWebUI(w, r)
+		})
+	})
+	a.mux.ServeHTTP(w, r)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func (a *Admin) serveFlows(w http.ResponseWriter, r *http.Request) {
+	rec := a.recorder()
+	if rec == nil {
+		writeJSONError(w, http.StatusNotFound, "no recorder")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		entries := rec.Entries()
+		if s := r.URL.Query().Get("limit"); s != "" {
+			limit, err := strconv.Atoi(s)
+			if err != nil || limit < 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid limit: "+s)
+				return
+			}
+			if limit < len(entries) {
+				entries = entries[len(entries)-limit:]
+			}
+		}
+		writeJSON(w, http.StatusOK, entries)
+	case "DELETE":
+		rec.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET", "DELETE")
+	}
+}
+
+func (a *Admin) serveHAR(w http.ResponseWriter, r *http.Request) {
+	rec := a.recorder()
+	if rec == nil {
+		writeJSONError(w, http.StatusNotFound, "no recorder")
+		return
+	}
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="groxy.har"`)
+	rec.Export(w)
+}
+
+func (a *Admin) serveEvents(w http.ResponseWriter, r *http.Request) {
+	rec := a.recorder()
+	if rec == nil {
+		writeJSONError(w, http.StatusNotFound, "no recorder")
+		return
+	}
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	entries, cancel := rec.Subscribe(100)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	// comments keep the stream alive through intermediaries closing idle connections.
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case entry := <-entries:
+			data, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: flow\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// connInfoJSON is ConnInfo in JSON.
+type connInfoJSON struct {
+	ID         uint64    `json:"id"`
+	Kind       string    `json:"kind"`
+	ClientAddr string    `json:"clientAddr"`
+	Host       string    `json:"host"`
+	Redirect   string    `json:"redirect,omitempty"`
+	Start      time.Time `json:"start"`
+	BytesIn    int64     `json:"bytesIn"`
+	BytesOut   int64     `json:"bytesOut"`
+	Requests   int64     `json:"requests"`
+}
+
+func (a *Admin) serveConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	conns := []connInfoJSON{}
+	for _, c := range a.Proxy.Connections() {
+		conns = append(conns, connInfoJSON{
+			ID:         c.ID,
+			Kind:       c.Kind.String(),
+			ClientAddr: c.ClientAddr,
+			Host:       c.Host,
+			Redirect:   c.Redirect,
+			Start:      c.Start,
+			BytesIn:    c.BytesIn,
+			BytesOut:   c.BytesOut,
+			Requests:   c.Requests,
+		})
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+func (a *Admin) serveConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		methodNotAllowed(w, "DELETE")
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/connections/"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid connection ID")
+		return
+	}
+	if err := a.Proxy.CloseConnection(id); err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	cur := a.Proxy.current()
+	v := struct {
+		HTTPSAction    HTTPSAction `json:"httpsAction"`
+		ConnectHandler bool        `json:"connectHandler"`
+		UpstreamProxy  string      `json:"upstreamProxy,omitempty"`
+		ClientACL      bool        `json:"clientACL"`
+		Blocker        bool        `json:"blocker"`
+		Authenticator  bool        `json:"authenticator"`
+		Middlewares    []string    `json:"middlewares"`
+		Config         *Config     `json:"config,omitempty"`
+	}{
+		HTTPSAction:    cur.httpsAction,
+		ConnectHandler: cur.connectHandler != nil,
+		ClientACL:      cur.clientACL != nil,
+		Blocker:        cur.blocker != nil,
+		Authenticator:  cur.authenticator != nil,
+		Middlewares:    a.Proxy.Middlewares.Names(),
+	}
+	if cur.upstreamProxy != nil {
+		// credentials of the upstream proxy must not be exposed.
+		u := *cur.upstreamProxy
+		u.User = nil
+		v.UpstreamProxy = u.String()
+	}
+	if a.Loader != nil {
+		if cfg := a.Loader.Config(); cfg != nil {
+			v.Config = cfg.redacted()
+		}
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (a *Admin) serveHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" && r.Method != "POST" {
+		methodNotAllowed(w, "PUT", "POST")
+		return
+	}
+	var body struct {
+		Action *HTTPSAction `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	if body.Action == nil {
+		writeJSONError(w, http.StatusBadRequest, "action is required")
+		return
+	}
+	action := *body.Action
+	a.Proxy.Reconfigure(func(p *ProxyServer) {
+		p.HTTPSAction = action
+	})
+	a.Proxy.log("HTTPS action is changed to ", action, " by ", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (a *Admin) serveCaches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" && r.Method != "POST" {
+		methodNotAllowed(w, "DELETE", "POST")
+		return
+	}
+	a.Proxy.CloseIdleConnections()
+	if a.Replayer != nil {
+		a.Replayer.Reset()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) serveIntercept(w http.ResponseWriter, r *http.Request) {
+	if a.Interceptor == nil {
+		writeJSONError(w, http.StatusNotFound, "no interceptor")
+		return
+	}
+	http.StripPrefix("/api/intercept", a.Interceptor.Handler()).ServeHTTP(w, r)
+}
@@ -0,0 +1,233 @@
+package groxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	tlsserver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsserver.Close()
+
+	recorder := &Recorder{}
+	proxy := &ProxyServer{}
+	proxy.Middlewares.UseNamed("recorder", recorder.Middleware())
+	proxy.NonProxyRequestHandler = &Admin{Proxy: proxy, Recorder: recorder, Interceptor: &Interceptor{}}
+	proxyserver := httptest.NewServer(proxy)
+	defer proxyserver.Close()
+	proxyurl, _ := url.Parse(proxyserver.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	call := func(method, path, body string, v interface{}) int {
+		req, _ := http.NewRequest(method, proxyserver.URL+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to request %s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("failed to decode response of %s %s: %v", method, path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var entries []HAREntry
+	if code := call("GET", "/api/flows", "", &entries); code != http.StatusOK || len(entries) != 1 || entries[0].Request.URL != ts.URL+"/" {
+		t.Errorf("expected the recorded flow, but got %d %v", code, entries)
+	}
+	if code := call("DELETE", "/api/flows", "", nil); code != http.StatusNoContent || len(recorder.Entries()) != 0 {
+		t.Errorf("expected flows are cleared, but got %d and %d entries", code, len(recorder.Entries()))
+	}
+
+	if code := call("PUT", "/api/https", `{"action": "mitm"}`, nil); code != http.StatusOK {
+		t.Errorf("expected status code of PUT /api/https is %d, but got %d", http.StatusOK, code)
+	}
+	if code := call("PUT", "/api/https", `{"action": "unknown"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected unknown actions get %d, but got %d", http.StatusBadRequest, code)
+	}
+	if code := call("PUT", "/api/https", `{}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected requests without action get %d, but got %d", http.StatusBadRequest, code)
+	}
+	var config struct {
+		HTTPSAction string   `json:"httpsAction"`
+		Middlewares []string `json:"middlewares"`
+	}
+	call("GET", "/api/config", "", &config)
+	if config.HTTPSAction != "mitm" || len(config.Middlewares) != 1 || config.Middlewares[0] != "recorder" {
+		t.Errorf("expected the current config, but got %+v", config)
+	}
+
+	conn, _ := connect(t, proxyserver, tlsserver.Listener.Addr().String())
+	defer conn.Close()
+	var conns []struct {
+		ID   uint64 `json:"id"`
+		Kind string `json:"kind"`
+	}
+	call("GET", "/api/connections", "", &conns)
+	if len(conns) != 1 || conns[0].Kind != "mitm" {
+		t.Fatalf("expected the MITM session, but got %v", conns)
+	}
+	if code := call("DELETE", "/api/connections/"+strconv.FormatUint(conns[0].ID, 10), "", nil); code != http.StatusNoContent {
+		t.Errorf("expected status code of closing the connection is %d, but got %d", http.StatusNoContent, code)
+	}
+	if n := len(proxy.Connections()); n != 0 {
+		t.Errorf("expected the connection is closed, but got %d connections", n)
+	}
+
+	var held []Intercepted
+	if code := call("GET", "/api/intercept/", "", &held); code != http.StatusOK || len(held) != 0 {
+		t.Errorf("expected no held flows, but got %d %v", code, held)
+	}
+	if code := call("DELETE", "/api/caches", "", nil); code != http.StatusNoContent {
+		t.Errorf("expected status code of clearing caches is %d, but got %d", http.StatusNoContent, code)
+	}
+	if code := call("GET", "/api/unknown", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected unknown endpoints get %d, but got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestAdminWebUIAndEvents(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	recorder := &Recorder{}
+	proxy := &ProxyServer{}
+	proxy.Use(recorder.Middleware())
+	proxy.NonProxyRequestHandler = &Admin{Proxy: proxy, Recorder: recorder}
+	proxyserver := httptest.NewServer(proxy)
+	defer proxyserver.Close()
+	proxyurl, _ := url.Parse(proxyserver.URL)
+
+	resp, err := http.Get(proxyserver.URL + "/")
+	if err != nil {
+		t.Fatalf("failed to get the web UI: %v", err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" || !strings.Contains(string(page), `new EventSource("/api/events")`) {
+		t.Errorf("expected the web UI page, but got %q", ct)
+	}
+
+	events, err := http.Get(proxyserver.URL + "/api/events")
+	if err != nil {
+		t.Fatalf("failed to get events: %v", err)
+	}
+	defer events.Body.Close()
+	if ct := events.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected Content-Type of events is %q, but got %q", "text/event-stream", ct)
+	}
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	resp, err = client.Get(ts.URL + "/live")
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	r := bufio.NewReader(events.Body)
+	event, _ := r.ReadString('\n')
+	data, _ := r.ReadString('\n')
+	if event != "event: flow\n" || !strings.HasPrefix(data, "data: ") {
+		t.Fatalf("expected a flow event, but got %q %q", event, data)
+	}
+	var entry HAREntry
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &entry); err != nil {
+		t.Fatalf("failed to decode the event: %v", err)
+	}
+	if entry.Request.URL != ts.URL+"/live" {
+		t.Errorf("expected the flow of %s, but got %s", ts.URL+"/live", entry.Request.URL)
+	}
+}
+
+func TestAdminAccessControl(t *testing.T) {
+	proxy := &ProxyServer{}
+	admin := &Admin{Proxy: proxy}
+	server := httptest.NewServer(admin)
+	defer server.Close()
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(method, path string, header map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(`{"action": "mitm"}`))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		if host, ok := header["Host"]; ok {
+			req.Host = host
+		}
+		resp, err := noRedirect.Do(req)
+		if err != nil {
+			t.Fatalf("failed to request %s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	jsonType := map[string]string{"Content-Type": "application/json"}
+
+	cases := []struct {
+		name   string
+		method string
+		header map[string]string
+		code   int
+	}{
+		{"loopback", "PUT", jsonType, http.StatusOK},
+		{"rebound host", "GET", map[string]string{"Host": "attacker.example"}, http.StatusForbidden},
+		{"no content type", "PUT", nil, http.StatusUnsupportedMediaType},
+		{"form", "PUT", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, http.StatusUnsupportedMediaType},
+		{"cross origin", "PUT", map[string]string{"Content-Type": "application/json", "Origin": "http://attacker.example"}, http.StatusForbidden},
+		{"cross site", "PUT", map[string]string{"Content-Type": "application/json", "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same origin", "PUT", map[string]string{"Content-Type": "application/json", "Origin": server.URL}, http.StatusOK},
+	}
+	for _, c := range cases {
+		if resp := do(c.method, "/api/https", c.header); resp.StatusCode != c.code {
+			t.Errorf("%s: expected status code is %d, but got %d", c.name, c.code, resp.StatusCode)
+		}
+	}
+
+	admin.Token = "secret"
+	if resp := do("GET", "/api/config", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected requests without token get %d, but got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if resp := do("GET", "/api/config", map[string]string{"Authorization": "Bearer wrong"}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected requests with a wrong token get %d, but got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if resp := do("GET", "/api/config", map[string]string{"Authorization": "Bearer secret", "Host": "proxy.example"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected requests with the token get %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	resp := do("GET", "/?token=secret", nil)
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == adminTokenCookie {
+			cookie = c
+		}
+	}
+	if resp.StatusCode != http.StatusSeeOther || cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("expected the token is stored in a cookie, but got %d %v", resp.StatusCode, resp.Cookies())
+	}
+	if resp := do("GET", "/api/config", map[string]string{"Cookie": cookie.Name + "=" + cookie.Value}); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected requests with the cookie get %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
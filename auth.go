@@ -0,0 +1,206 @@
+package groxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator authenticates proxy requests by their Proxy-Authorization header.
+type Authenticator interface {
+	// Authenticate returns the identity of the user who sent r, or false if r is not authenticated.
+	Authenticate(r *http.Request) (user string, ok bool)
+	// Challenge returns the value of Proxy-Authenticate header sent with http.StatusProxyAuthRequired.
+	Challenge() string
+}
+
+const defaultRealm = "groxy"
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	flowContextKey
+	upstreamContextKey
+	mapRemoteContextKey
+)
+
+// UserFromContext returns the user authenticated by ProxyServer.Authenticator.
+// Middlewares can get it from the request context.
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userContextKey).(string)
+	return user, ok
+}
+
+func (p *ProxyServer) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	auth := p.current().authenticator
+	if auth == nil {
+		return r, true
+	}
+	user, ok := auth.Authenticate(r)
+	if !ok {
+		p.log("proxy authentication failed: ", r.RemoteAddr)
+		w.Header().Set("Proxy-Authenticate", auth.Challenge())
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return nil, false
+	}
+	r.Header.Del("Proxy-Authorization")
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user)), true
+}
+
+func proxyCredentials(r *http.Request, scheme string) (string, bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if len(auth) < len(scheme)+1 || !strings.EqualFold(auth[:len(scheme)+1], scheme+" ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(scheme)+1:]), true
+}
+
+func proxyBasicAuth(r *http.Request) (user, password string, ok bool) {
+	cred, ok := proxyCredentials(r, "Basic")
+	if !ok {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(cred)
+	if err != nil {
+		return "", "", false
+	}
+	i := strings.IndexByte(string(b), ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return string(b[:i]), string(b[i+1:]), true
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func basicChallenge(realm string) string {
+	if realm == "" {
+		realm = defaultRealm
+	}
+	return `Basic realm="` + realm + `"`
+}
+
+// BasicAuth is an Authenticator that checks Basic credentials against a static map.
+type BasicAuth struct {
+	Realm string
+	// Users maps user names to their passwords.
+	Users map[string]string
+}
+
+// Authenticate implements Authenticator.
+func (a *BasicAuth) Authenticate(r *http.Request) (string, bool) {
+	user, password, ok := proxyBasicAuth(r)
+	if !ok {
+		return "", false
+	}
+	expected, ok := a.Users[user]
+	if !ok || !secureCompare(password, expected) {
+		return "", false
+	}
+	return user, true
+}
+
+// Challenge implements Authenticator.
+func (a *BasicAuth) Challenge() string {
+	return basicChallenge(a.Realm)
+}
+
+// HtpasswdAuth is an Authenticator that checks Basic credentials against bcrypt hashes of an htpasswd file.
+type HtpasswdAuth struct {
+	Realm  string
+	hashes map[string][]byte
+}
+
+// LoadHtpasswd reads an htpasswd file.
+func LoadHtpasswd(filename string) (*HtpasswdAuth, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open htpasswd file")
+	}
+	defer f.Close()
+	return ParseHtpasswd(f)
+}
+
+// ParseHtpasswd reads htpasswd entries from r. Only bcrypt hashes are supported.
+func ParseHtpasswd(r io.Reader) (*HtpasswdAuth, error) {
+	a := &HtpasswdAuth{hashes: make(map[string][]byte)}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, errors.Errorf("htpasswd line %d: missing separator", n)
+		}
+		hash := line[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, errors.Errorf("htpasswd line %d: unsupported hash (only bcrypt is supported)", n)
+		}
+		a.hashes[line[:i]] = []byte(hash)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read htpasswd")
+	}
+	return a, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *HtpasswdAuth) Authenticate(r *http.Request) (string, bool) {
+	user, password, ok := proxyBasicAuth(r)
+	if !ok {
+		return "", false
+	}
+	hash, ok := a.hashes[user]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+	return user, true
+}
+
+// Challenge implements Authenticator.
+func (a *HtpasswdAuth) Challenge() string {
+	return basicChallenge(a.Realm)
+}
+
+// BearerAuth is an Authenticator that checks Bearer tokens.
+type BearerAuth struct {
+	Realm string
+	// Tokens maps tokens to the users who own them.
+	Tokens map[string]string
+}
+
+// Authenticate implements Authenticator.
+func (a *BearerAuth) Authenticate(r *http.Request) (string, bool) {
+	token, ok := proxyCredentials(r, "Bearer")
+	if !ok {
+		return "", false
+	}
+	for t, user := range a.Tokens {
+		if secureCompare(token, t) {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// Challenge implements Authenticator.
+func (a *BearerAuth) Challenge() string {
+	realm := a.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+	return `Bearer realm="` + realm + `"`
+}
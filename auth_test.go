@@ -0,0 +1,143 @@
+package groxy
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestProxyAuthentication(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Proxy-Authorization")))
+	}))
+	defer ts.Close()
+
+	log := &recordLogger{}
+	proxy := ProxyServer{Logger: log}
+	proxy.Authenticator = &BasicAuth{Users: map[string]string{"alice": "secret"}}
+	var gotUser string
+	proxy.Use(func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			gotUser, _ = UserFromContext(req.Context())
+			return h(req)
+		}
+	})
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("expected status code is %v, but got %v", http.StatusProxyAuthRequired, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Proxy-Authenticate"); got != `Basic realm="groxy"` {
+		t.Errorf("expected Proxy-Authenticate is %q, but got %q", `Basic realm="groxy"`, got)
+	}
+
+	proxyurl.User = url.UserPassword("alice", "secret")
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	resp, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status code is %v, but got %v", http.StatusOK, resp.StatusCode)
+	}
+	if len(body) != 0 {
+		t.Errorf("expected Proxy-Authorization is not forwarded, but got %q", string(body))
+	}
+	if gotUser != "alice" {
+		t.Errorf("expected user is %q, but got %q", "alice", gotUser)
+	}
+	if log.contains("Proxy-Authorization") || log.contains(base64.StdEncoding.EncodeToString([]byte("alice:secret"))) {
+		t.Errorf("expected credentials are not logged, but got %v", log.logs)
+	}
+}
+
+func TestProxyAuthenticationMITM(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	var proxy ProxyServer
+	proxy.HTTPSAction = HTTPSActionMITM
+	proxy.Authenticator = &BearerAuth{Tokens: map[string]string{"token": "bob"}}
+	var gotUser string
+	proxy.Use(func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			gotUser, _ = UserFromContext(req.Context())
+			return h(req)
+		}
+	})
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:              http.ProxyURL(proxyurl),
+			ProxyConnectHeader: http.Header{"Proxy-Authorization": {"Bearer token"}},
+			TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	resp.Body.Close()
+	if gotUser != "bob" {
+		t.Errorf("expected user is %q, but got %q", "bob", gotUser)
+	}
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := ParseHtpasswd(strings.NewReader(fmt.Sprintf("# comment\nalice:%s\n", hash)))
+	if err != nil {
+		t.Fatalf("failed to parse htpasswd: %v", err)
+	}
+
+	cases := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "http://example.com", nil)
+		r.SetBasicAuth(c.user, c.password)
+		r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+		if _, ok := auth.Authenticate(r); ok != c.ok {
+			t.Errorf("expected authentication of %s:%s is %v, but got %v", c.user, c.password, c.ok, ok)
+		}
+	}
+
+	if _, err := ParseHtpasswd(strings.NewReader("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")); err == nil {
+		t.Errorf("expected non-bcrypt hashes are rejected, but no error occurred")
+	}
+}
@@ -0,0 +1,221 @@
+package groxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// HostList is a set of host rules. A rule is one of:
+//
+//	example.com     matches example.com exactly
+//	.example.com    matches example.com and all of its subdomains
+//	*.example.com   matches hosts by the glob pattern (see path.Match), e.g. subdomains of example.com
+//
+// HostList is safe for concurrent use.
+type HostList struct {
+	mu       sync.RWMutex
+	exact    map[string]bool
+	suffixes []string
+	globs    []string
+}
+
+// NewHostList creates a HostList from rules.
+func NewHostList(rules ...string) (*HostList, error) {
+	l := &HostList{exact: make(map[string]bool)}
+	for _, rule := range rules {
+		if err := l.Add(rule); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// LoadHostList reads rules from a file. See ParseHostList for the format.
+func LoadHostList(filename string) (*HostList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open host list")
+	}
+	defer f.Close()
+	return ParseHostList(f)
+}
+
+// localHostNames are names found in hosts files that must not be treated as rules.
+var localHostNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+}
+
+// ParseHostList reads rules from r. Each line is either a rule or an entry of hosts file format
+// (e.g. "0.0.0.0 ads.example.com"), whose host names are added as exact rules.
+// Empty lines and comments starting with '#' are ignored.
+func ParseHostList(r io.Reader) (*HostList, error) {
+	l, _ := NewHostList()
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		} else if len(fields) > 1 {
+			return nil, errors.Errorf("host list line %d: too many fields", n)
+		}
+		for _, f := range fields {
+			if localHostNames[strings.ToLower(f)] {
+				continue
+			}
+			if err := l.Add(f); err != nil {
+				return nil, errors.Wrapf(err, "host list line %d", n)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read host list")
+	}
+	return l, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Add adds a rule to l.
+func (l *HostList) Add(rule string) error {
+	rule = normalizeHost(strings.TrimSpace(rule))
+	if rule == "" || rule == "." {
+		return errors.New("empty host rule")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case strings.ContainsAny(rule, "*?["):
+		if _, err := path.Match(rule, ""); err != nil {
+			return errors.Wrapf(err, "invalid host pattern %q", rule)
+		}
+		l.globs = append(l.globs, rule)
+	case strings.HasPrefix(rule, "."):
+		l.suffixes = append(l.suffixes, rule)
+	default:
+		l.exact[rule] = true
+	}
+	return nil
+}
+
+// merge adds rules of other to l.
+func (l *HostList) merge(other *HostList) {
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for host := range other.exact {
+		l.exact[host] = true
+	}
+	l.suffixes = append(l.suffixes, other.suffixes...)
+	l.globs = append(l.globs, other.globs...)
+}
+
+// Match reports whether host matches any rule of l. host may contain a port.
+func (l *HostList) Match(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeHost(host)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.exact[host] {
+		return true
+	}
+	for _, s := range l.suffixes {
+		if host == s[1:] || strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+	for _, g := range l.globs {
+		if ok, _ := path.Match(g, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocker blocks requests by their destination hosts.
+// Set it to ProxyServer.Blocker to check both proxy requests and CONNECT requests.
+type Blocker struct {
+	// Deny lists blocked hosts.
+	Deny *HostList
+	// Allow lists the only hosts permitted if it's non-nil. Hosts in Deny are blocked even if they are allowed.
+	Allow *HostList
+	// StatusCode is a status code of block responses. If it's zero, http.StatusForbidden is used.
+	StatusCode int
+	// BlockPage is a body of block responses.
+	BlockPage string
+	// ContentType is a content type of BlockPage. If it's empty, "text/plain; charset=utf-8" is used.
+	ContentType string
+}
+
+// Blocks reports whether requests to host should be blocked. host may contain a port.
+func (b *Blocker) Blocks(host string) bool {
+	if b.Deny != nil && b.Deny.Match(host) {
+		return true
+	}
+	return b.Allow != nil && !b.Allow.Match(host)
+}
+
+func (b *Blocker) response(req *http.Request) *http.Response {
+	code := b.StatusCode
+	if code == 0 {
+		code = http.StatusForbidden
+	}
+	contentType := b.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	body := b.BlockPage
+	if body == "" {
+		body = "blocked by proxy: " + req.URL.Host + "\n"
+	}
+	return NewResponse(req, code, contentType, []byte(body))
+}
+
+// Middleware returns a Middleware that responds the block page instead of requesting blocked hosts.
+// It's useful to block hosts only for some of requests, e.g. combining it with other middlewares.
+func (b *Blocker) Middleware() Middleware {
+	return func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			if b.Blocks(req.URL.Host) {
+				return b.response(req), nil
+			}
+			return h(req)
+		}
+	}
+}
+
+func (p *ProxyServer) permitsHost(w http.ResponseWriter, r *http.Request) bool {
+	b := p.current().blocker
+	if b == nil || !b.Blocks(r.URL.Host) {
+		return true
+	}
+	p.log("blocked request to ", r.URL.Host, " from ", r.RemoteAddr)
+	resp := b.response(r)
+	defer resp.Body.Close()
+	copyResponse(w, resp)
+	return false
+}
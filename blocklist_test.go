@@ -0,0 +1,121 @@
+package groxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHostListMatch(t *testing.T) {
+	list, err := ParseHostList(strings.NewReader(`
+# hosts file entries
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.net
+# plain rules
+exact.example.org
+.suffix.example.org
+*.wild.example.org # trailing comment
+`))
+	if err != nil {
+		t.Fatalf("failed to parse host list: %v", err)
+	}
+	cases := []struct {
+		host     string
+		expected bool
+	}{
+		{"ads.example.com", true},
+		{"ADS.example.com.", true},
+		{"tracker.example.net:443", true},
+		{"example.com", false},
+		{"localhost", false},
+		{"exact.example.org", true},
+		{"sub.exact.example.org", false},
+		{"suffix.example.org", true},
+		{"a.b.suffix.example.org", true},
+		{"notsuffix.example.org", false},
+		{"wild.example.org", false},
+		{"a.wild.example.org", true},
+	}
+	for _, c := range cases {
+		if got := list.Match(c.host); got != c.expected {
+			t.Errorf("expected Match(%s) is %v, but got %v", c.host, c.expected, got)
+		}
+	}
+
+	if _, err := ParseHostList(strings.NewReader("two rules\n")); err == nil {
+		t.Errorf("expected malformed lines are rejected, but no error occurred")
+	}
+}
+
+func TestBlockerBlocksRequests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	tsurl, _ := url.Parse(ts.URL)
+
+	deny, _ := NewHostList(tsurl.Hostname())
+	var proxy ProxyServer
+	proxy.Blocker = &Blocker{Deny: deny, BlockPage: "<h1>blocked</h1>", ContentType: "text/html"}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || string(body) != "<h1>blocked</h1>" {
+		t.Errorf("expected the block page, but got %v %q", resp.StatusCode, string(body))
+	}
+
+	conn, resp := connect(t, proxyserver, ts.Listener.Addr().String())
+	conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status code of CONNECT is %v, but got %v", http.StatusForbidden, resp.StatusCode)
+	}
+
+	allow, _ := NewHostList(".example.com")
+	proxy.Blocker = &Blocker{Allow: allow}
+	if !proxy.Blocker.Blocks(ts.Listener.Addr().String()) || proxy.Blocker.Blocks("www.example.com:443") {
+		t.Errorf("expected only allowed hosts are permitted")
+	}
+}
+
+func TestBlockerInMITM(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	deny, _ := NewHostList("blocked.test")
+	proxy := ProxyServer{HTTPSAction: HTTPSActionMITM, Blocker: &Blocker{Deny: deny}}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	cases := []struct {
+		host     string
+		expected int
+	}{
+		{ts.Listener.Addr().String(), http.StatusOK},
+		// the request names a blocked host in the tunnel to an allowed one.
+		{"blocked.test", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		conn, resp := connect(t, proxyserver, ts.Listener.Addr().String())
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code of CONNECT is %v, but got %v", http.StatusOK, resp.StatusCode)
+		}
+		if resp := mitmGet(t, conn, c.host); resp.StatusCode != c.expected {
+			t.Errorf("%s: expected status code is %v, but got %v", c.host, c.expected, resp.StatusCode)
+		}
+		conn.Close()
+	}
+}
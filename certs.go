@@ -1,11 +1,111 @@
 package groxy
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 var groxyCa tls.Certificate
 
+const (
+	// maxLeafCertificates is the number of cached certificates signed by a CA.
+	maxLeafCertificates = 1000
+	// leafValidity is the validity period of certificates signed by a CA.
+	leafValidity = 365 * 24 * time.Hour
+)
+
+// leafCertificates signs certificates of hosts by a CA for MITM sessions, and caches them.
+type leafCertificates struct {
+	mu     sync.Mutex
+	ca     *tls.Certificate
+	caCert *x509.Certificate // nil if ca is not a CA certificate.
+	certs  map[string]*tls.Certificate
+}
+
+// get returns the certificate for host signed by ca.
+// If ca is not a CA certificate, it returns ca itself.
+func (l *leafCertificates) get(ca *tls.Certificate, host string) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ca != ca {
+		caCert, err := x509.ParseCertificate(ca.Certificate[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse CA")
+		}
+		l.ca, l.caCert, l.certs = ca, nil, nil
+		if caCert.IsCA {
+			l.caCert = caCert
+		}
+	}
+	if l.caCert == nil {
+		return ca, nil
+	}
+	host = normalizeHost(host)
+	// certificates are renewed a day before they expire, unless they expire with ca.
+	if cert, ok := l.certs[host]; ok {
+		if !cert.Leaf.NotAfter.Before(l.caCert.NotAfter) || time.Now().Add(24*time.Hour).Before(cert.Leaf.NotAfter) {
+			return cert, nil
+		}
+	}
+	cert, err := signLeaf(ca, l.caCert, host)
+	if err != nil {
+		return nil, err
+	}
+	if l.certs == nil || len(l.certs) >= maxLeafCertificates {
+		l.certs = make(map[string]*tls.Certificate)
+	}
+	l.certs[host] = cert
+	return cert, nil
+}
+
+// signLeaf creates a certificate for host signed by ca.
+func signLeaf(ca *tls.Certificate, caCert *x509.Certificate, host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number")
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if caCert.NotAfter.Before(tmpl.NotAfter) {
+		tmpl.NotAfter = caCert.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to sign certificate for %s", host)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse signed certificate")
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, ca.Certificate[0]}, PrivateKey: key, Leaf: leaf}, nil
+}
+
 func init() {
 	var err error
 	groxyCa, err = tls.X509KeyPair(caCert, caKey)
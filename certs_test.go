@@ -0,0 +1,100 @@
+package groxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestCA(t *testing.T) (*tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "groxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestLeafCertificates(t *testing.T) {
+	ca, pool := newTestCA(t)
+	var leaves leafCertificates
+	cert, err := leaves.get(ca, "Example.com")
+	if err != nil {
+		t.Fatalf("failed to sign certificate: %v", err)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: pool}); err != nil {
+		t.Errorf("expected the certificate is valid for example.com, but got %v", err)
+	}
+	if cached, _ := leaves.get(ca, "example.com"); cached != cert {
+		t.Errorf("expected the certificate is cached")
+	}
+	if cert.Leaf.NotAfter.After(time.Now().Add(24 * time.Hour)) {
+		t.Errorf("expected the certificate expires before the CA, but got %v", cert.Leaf.NotAfter)
+	}
+
+	// certificates which are not CA are presented as is.
+	if got, _ := leaves.get(cert, "example.com"); got != cert {
+		t.Errorf("expected the certificate which is not CA is returned as is")
+	}
+}
+
+func TestHTTPSManInTheMiddleWithCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	ca, pool := newTestCA(t)
+	proxy := ProxyServer{HTTPSAction: HTTPSActionMITM, CA: ca}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client trusts only the CA, and verifies the certificate for 127.0.0.1.
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyurl),
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("expected response body is %q, but got %q", "hello", string(body))
+	}
+}
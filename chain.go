@@ -0,0 +1,171 @@
+package groxy
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Chain is an ordered list of middlewares.
+// The first middleware is the outermost one, i.e. it receives requests first and responses last.
+// Middlewares can have names to insert others before or after them, or to remove them later.
+// Chain is safe for concurrent use, so middlewares can be changed while serving.
+type Chain struct {
+	mu      sync.RWMutex
+	entries []chainEntry
+}
+
+type chainEntry struct {
+	name string
+	m    Middleware
+}
+
+// Use appends unnamed middlewares to the innermost of c.
+func (c *Chain) Use(ms ...Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range ms {
+		c.entries = append(c.entries, chainEntry{m: m})
+	}
+}
+
+func (c *Chain) index(name string) int {
+	for i, e := range c.entries {
+		if e.name != "" && e.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *Chain) insert(i int, name string, m Middleware) error {
+	if name != "" && c.index(name) >= 0 {
+		return errors.Errorf("middleware %q already exists", name)
+	}
+	c.entries = append(c.entries, chainEntry{})
+	copy(c.entries[i+1:], c.entries[i:])
+	c.entries[i] = chainEntry{name: name, m: m}
+	return nil
+}
+
+// UseNamed appends a named middleware to the innermost of c.
+func (c *Chain) UseNamed(name string, m Middleware) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.insert(len(c.entries), name, m)
+}
+
+// InsertBefore inserts a named middleware just outside of the middleware named target.
+func (c *Chain) InsertBefore(target, name string, m Middleware) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.index(target)
+	if i < 0 {
+		return errors.Errorf("middleware %q not found", target)
+	}
+	return c.insert(i, name, m)
+}
+
+// InsertAfter inserts a named middleware just inside of the middleware named target.
+func (c *Chain) InsertAfter(target, name string, m Middleware) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.index(target)
+	if i < 0 {
+		return errors.Errorf("middleware %q not found", target)
+	}
+	return c.insert(i+1, name, m)
+}
+
+// Replace replaces the middleware named name, or appends it if there is no such middleware.
+func (c *Chain) Replace(name string, m Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i := c.index(name); i >= 0 {
+		c.entries[i].m = m
+		return
+	}
+	c.entries = append(c.entries, chainEntry{name: name, m: m})
+}
+
+// Remove removes the middleware named name, and reports whether it existed.
+func (c *Chain) Remove(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.index(name)
+	if i < 0 {
+		return false
+	}
+	c.entries = append(c.entries[:i], c.entries[i+1:]...)
+	return true
+}
+
+// setManaged makes middlewares named names be ms[name] in the order of names, keeping other middlewares.
+// Missing ones are removed, and new ones are inserted next to the preceding existing one in names,
+// or at the innermost if there is no such one.
+func (c *Chain) setManaged(names []string, ms map[string]Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		if _, ok := ms[name]; ok {
+			continue
+		}
+		if i := c.index(name); i >= 0 {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+		}
+	}
+	pos := -1
+	for _, name := range names {
+		m, ok := ms[name]
+		if !ok {
+			continue
+		}
+		if i := c.index(name); i >= 0 {
+			c.entries[i].m = m
+			pos = i
+			continue
+		}
+		if pos < 0 {
+			pos = len(c.entries)
+			for j, e := range c.entries {
+				if containsString(names, e.name) {
+					pos = j
+					break
+				}
+			}
+		} else {
+			pos++
+		}
+		c.insert(pos, name, m)
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Names returns names of middlewares from the outermost. Unnamed middlewares are represented as "".
+func (c *Chain) Names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, len(c.entries))
+	for i, e := range c.entries {
+		names[i] = e.name
+	}
+	return names
+}
+
+// Then wraps h with the middlewares of c.
+func (c *Chain) Then(h Handler) Handler {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for i := len(c.entries) - 1; i >= 0; i-- {
+		h = c.entries[i].m(h)
+	}
+	return h
+}
@@ -0,0 +1,55 @@
+package groxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func tracer(name string, trace *[]string) Middleware {
+	return func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			*trace = append(*trace, name)
+			return h(req)
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var trace []string
+	var c Chain
+	c.Use(tracer("first", &trace))
+	if err := c.UseNamed("auth", tracer("auth", &trace)); err != nil {
+		t.Fatal(err)
+	}
+	c.Use(tracer("last", &trace))
+	if err := c.InsertBefore("auth", "log", tracer("log", &trace)); err != nil {
+		t.Fatalf("failed to insert before: %v", err)
+	}
+	if err := c.InsertAfter("auth", "mock", tracer("mock", &trace)); err != nil {
+		t.Fatalf("failed to insert after: %v", err)
+	}
+	if err := c.UseNamed("log", tracer("log", &trace)); err == nil {
+		t.Errorf("expected duplicated names are rejected, but no error occurred")
+	}
+	if err := c.InsertAfter("unknown", "x", tracer("x", &trace)); err == nil {
+		t.Errorf("expected unknown targets are rejected, but no error occurred")
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	handler := c.Then(func(req *http.Request) (*http.Response, error) {
+		return NewResponse(req, http.StatusOK, "", nil), nil
+	})
+	handler(req)
+	expected := []string{"first", "log", "auth", "mock", "last"}
+	if !reflect.DeepEqual(trace, expected) {
+		t.Errorf("expected middlewares are called in %v, but got %v", expected, trace)
+	}
+
+	if !c.Remove("auth") || c.Remove("auth") {
+		t.Errorf("expected a named middleware is removed only once")
+	}
+	if names := c.Names(); !reflect.DeepEqual(names, []string{"", "log", "mock", ""}) {
+		t.Errorf("unexpected names after removal: %q", names)
+	}
+}
@@ -0,0 +1,223 @@
+// Command groxy runs a groxy proxy server.
+//
+//	$ groxy -listen :8888 -mode mitm -har ./har
+//
+// Settings can also be written in a config file (see groxy.Config), which is reloaded when it's modified or
+// groxy receives SIGHUP. Flags given explicitly take precedence over the config file.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/agatan/groxy"
+)
+
+type textLogger struct{}
+
+func (textLogger) Print(args ...interface{}) {
+	log.Print(args...)
+}
+
+type jsonLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (l *jsonLogger) Print(args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(struct {
+		Time    time.Time `json:"time"`
+		Message string    `json:"msg"`
+	}{time.Now(), fmt.Sprint(args...)})
+}
+
+type options struct {
+	listen      string
+	mode        string
+	caCert      string
+	caKey       string
+	upstream    string
+	logFormat   string
+	har         string
+	config      string
+	reload      time.Duration
+	admin       bool
+	adminListen string
+	adminToken  string
+}
+
+func parseMode(mode string) (groxy.HTTPSAction, error) {
+	// "tunnel" is easier to understand than "proxy" for users of the command.
+	if strings.EqualFold(mode, "tunnel") {
+		return groxy.HTTPSActionProxy, nil
+	}
+	return groxy.ParseHTTPSAction(mode)
+}
+
+// override applies flags set explicitly to cfg.
+func (o *options) override(cfg *groxy.Config, set map[string]bool) error {
+	if set["listen"] || cfg.Listen == "" {
+		cfg.Listen = o.listen
+	}
+	if set["mode"] {
+		action, err := parseMode(o.mode)
+		if err != nil {
+			return err
+		}
+		cfg.HTTPS = groxy.HTTPSConfig{Action: action}
+	}
+	if set["ca-cert"] || set["ca-key"] {
+		if o.caCert == "" || o.caKey == "" {
+			return fmt.Errorf("both of -ca-cert and -ca-key are required")
+		}
+		cfg.CA = &groxy.CAConfig{Cert: o.caCert, Key: o.caKey}
+	}
+	if set["upstream"] {
+		cfg.UpstreamProxy = o.upstream
+	}
+	if set["har"] {
+		cfg.Recorder = &groxy.RecorderConfig{Dir: o.har}
+	}
+	if o.admin && cfg.Recorder == nil {
+		// the admin API and the web UI show flows kept in memory.
+		cfg.Recorder = &groxy.RecorderConfig{}
+	}
+	return nil
+}
+
+// isLoopback reports whether the host of addr is a loopback address or localhost.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func main() {
+	var o options
+	flag.StringVar(&o.listen, "listen", ":8888", "address to listen on")
+	flag.StringVar(&o.mode, "mode", "tunnel", "how to handle HTTPS: tunnel, mitm or reject")
+	flag.StringVar(&o.caCert, "ca-cert", "", "PEM encoded CA certificate to sign certificates of hosts for MITM (default: builtin)")
+	flag.StringVar(&o.caKey, "ca-key", "", "PEM encoded private key of -ca-cert")
+	flag.StringVar(&o.upstream, "upstream", "", "upstream proxy URL, e.g. http://proxy.internal:3128 (default: from environment variables)")
+	flag.StringVar(&o.logFormat, "log-format", "text", "log format: text or json")
+	flag.StringVar(&o.har, "har", "", "directory to write HAR files of proxied traffic")
+	flag.StringVar(&o.config, "config", "", "config file (JSON)")
+	flag.BoolVar(&o.admin, "admin", false, "serve the web UI and the admin API on -admin-listen")
+	flag.StringVar(&o.adminListen, "admin-listen", "127.0.0.1:8889", "address to serve the admin API on")
+	flag.StringVar(&o.adminToken, "admin-token", os.Getenv("GROXY_ADMIN_TOKEN"), "token to access the admin API, required unless -admin-listen is a loopback address (default: $GROXY_ADMIN_TOKEN)")
+	flag.DurationVar(&o.reload, "reload-interval", 2*time.Second, "interval to check modification of the config file")
+	flag.Parse()
+
+	if err := run(&o); err != nil {
+		fmt.Fprintln(os.Stderr, "groxy:", err)
+		os.Exit(1)
+	}
+}
+
+func run(o *options) error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	// flags are validated here, so that they can be applied to every reloaded config.
+	if err := o.override(&groxy.Config{}, set); err != nil {
+		return err
+	}
+
+	var logger groxy.Logger
+	switch o.logFormat {
+	case "text":
+		logger = textLogger{}
+	case "json":
+		logger = &jsonLogger{enc: json.NewEncoder(os.Stderr)}
+	default:
+		return fmt.Errorf("unknown log format: %q", o.logFormat)
+	}
+
+	proxy := &groxy.ProxyServer{Logger: logger}
+	loader := &groxy.ConfigLoader{Filename: o.config, Proxy: proxy, Logger: logger}
+	loader.Override = func(cfg *groxy.Config) {
+		o.override(cfg, set)
+	}
+	if o.config != "" {
+		if err := loader.Load(); err != nil {
+			return err
+		}
+		stop := loader.Watch(o.reload)
+		defer stop()
+	} else {
+		cfg := &groxy.Config{}
+		loader.Override(cfg)
+		if err := loader.Apply(cfg); err != nil {
+			return err
+		}
+	}
+
+	srv := &http.Server{Addr: loader.Config().Listen, Handler: proxy}
+	errc := make(chan error, 2)
+	go func() {
+		logger.Print("listening on ", srv.Addr)
+		errc <- srv.ListenAndServe()
+	}()
+	servers := []*http.Server{srv}
+	if o.admin {
+		if o.adminToken == "" && !isLoopback(o.adminListen) {
+			return fmt.Errorf("-admin-token is required to serve the admin API on %s", o.adminListen)
+		}
+		admin := &http.Server{Addr: o.adminListen, Handler: &groxy.Admin{Proxy: proxy, Loader: loader, Token: o.adminToken}}
+		go func() {
+			logger.Print("serving the admin API on ", admin.Addr)
+			errc <- admin.ListenAndServe()
+		}()
+		servers = append(servers, admin)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		logger.Print("shutting down by ", s)
+	}
+
+	// srv.Shutdown doesn't wait for hijacked connections, so tunnels and MITM sessions are drained concurrently.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		proxy.Shutdown(ctx)
+	}()
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			s.Shutdown(ctx)
+		}(s)
+	}
+	wg.Wait()
+	if rec := loader.Recorder(); rec != nil {
+		if err := rec.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,582 @@
+package groxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config is a configuration of ProxyServer, usually written in a JSON file:
+//
+//	{
+//	  "listen": ":8888",
+//	  "https": {"action": "proxy", "rules": [{"hosts": [".example.com"], "action": "mitm"}]},
+//	  "ca": {"cert": "ca.pem", "key": "ca-key.pem"},
+//	  "upstreamProxy": "http://proxy.internal:3128",
+//	  "clientACL": {"allow": ["10.0.0.0/8"]},
+//	  "auth": {"htpasswd": "htpasswd"},
+//	  "destinationPolicy": {"allow": ["10.1.0.0/16"]},
+//	  "connectPorts": {"ports": [443], "hosts": {"git.example.com": [22, 443]}},
+//	  "blocklist": {"denyFiles": ["hosts.txt"], "deny": ["*.ads.example"]},
+//	  "recorder": {"dir": "har"},
+//	  "mocks": "mocks.json",
+//	  "mapLocal": [{"url": "example.com/static/", "path": "static"}],
+//	  "mapRemote": [{"from": "api.example.com/", "to": "http://localhost:8080/"}]
+//	}
+//
+// Relative paths in a config file are resolved from the directory of the file.
+type Config struct {
+	// Listen is the address to listen on. It's not used by ProxyServer, but by programs running it.
+	Listen        string      `json:"listen,omitempty"`
+	HTTPS         HTTPSConfig `json:"https"`
+	CA            *CAConfig   `json:"ca,omitempty"`
+	UpstreamProxy string      `json:"upstreamProxy,omitempty"`
+	ClientACL     *ACLConfig  `json:"clientACL,omitempty"`
+	Auth          *AuthConfig `json:"auth,omitempty"`
+	// DestinationPolicy enables DestinationPolicy with networks allowed and denied in addition to the default ones.
+	DestinationPolicy *ACLConfig       `json:"destinationPolicy,omitempty"`
+	ConnectPorts      *PortPolicy      `json:"connectPorts,omitempty"`
+	Blocklist         *BlocklistConfig `json:"blocklist,omitempty"`
+	Recorder          *RecorderConfig  `json:"recorder,omitempty"`
+	// Mocks is a mock file (see Mocks).
+	Mocks     string          `json:"mocks,omitempty"`
+	MapLocal  []LocalMapping  `json:"mapLocal,omitempty"`
+	MapRemote []RemoteMapping `json:"mapRemote,omitempty"`
+}
+
+// HTTPSConfig configures how to handle CONNECT requests.
+type HTTPSConfig struct {
+	// Action is set to ProxyServer.HTTPSAction, which is applied to CONNECT requests matching no rules.
+	Action HTTPSAction `json:"action"`
+	// Rules are applied to CONNECT requests to their hosts. The first matching rule is used.
+	Rules []HTTPSRule `json:"rules,omitempty"`
+}
+
+// HTTPSRule is an HTTPSAction for some hosts.
+type HTTPSRule struct {
+	// Hosts are host rules of HostList.
+	Hosts  []string    `json:"hosts"`
+	Action HTTPSAction `json:"action"`
+}
+
+// CAConfig is a pair of PEM encoded files of the certificate for MITM sessions and its private key.
+// If the certificate is a CA certificate, certificates of requested hosts are signed by it (see ProxyServer.CA).
+type CAConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// ACLConfig is networks of an ACL in CIDR notation.
+type ACLConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// AuthConfig configures an Authenticator. Exactly one of Users, Htpasswd and Tokens must be set.
+type AuthConfig struct {
+	Realm string `json:"realm,omitempty"`
+	// Users maps user names to their passwords (see BasicAuth).
+	Users map[string]string `json:"users,omitempty"`
+	// Htpasswd is an htpasswd file (see HtpasswdAuth).
+	Htpasswd string `json:"htpasswd,omitempty"`
+	// Tokens maps Bearer tokens to the users who own them (see BearerAuth).
+	Tokens map[string]string `json:"tokens,omitempty"`
+}
+
+func (c *AuthConfig) authenticator() (Authenticator, error) {
+	n := 0
+	for _, set := range []bool{len(c.Users) > 0, c.Htpasswd != "", len(c.Tokens) > 0} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, errors.New("exactly one of users, htpasswd and tokens is required for auth")
+	}
+	switch {
+	case len(c.Users) > 0:
+		return &BasicAuth{Realm: c.Realm, Users: c.Users}, nil
+	case len(c.Tokens) > 0:
+		return &BearerAuth{Realm: c.Realm, Tokens: c.Tokens}, nil
+	}
+	a, err := LoadHtpasswd(c.Htpasswd)
+	if err != nil {
+		return nil, err
+	}
+	a.Realm = c.Realm
+	return a, nil
+}
+
+// redacted returns a copy of cfg without credentials.
+func (cfg *Config) redacted() *Config {
+	c := *cfg
+	if u, err := url.Parse(c.UpstreamProxy); err == nil && u.User != nil {
+		u.User = nil
+		c.UpstreamProxy = u.String()
+	}
+	if a := c.Auth; a != nil {
+		c.Auth = &AuthConfig{Realm: a.Realm, Htpasswd: a.Htpasswd}
+		if len(a.Users) > 0 {
+			c.Auth.Users = make(map[string]string, len(a.Users))
+			for user := range a.Users {
+				c.Auth.Users[user] = "********"
+			}
+		}
+		if len(a.Tokens) > 0 {
+			c.Auth.Tokens = map[string]string{"********": ""}
+		}
+	}
+	return &c
+}
+
+// BlocklistConfig configures a Blocker.
+type BlocklistConfig struct {
+	// Deny and DenyFiles are host rules and files of them to block (see ParseHostList).
+	Deny      []string `json:"deny,omitempty"`
+	DenyFiles []string `json:"denyFiles,omitempty"`
+	// Allow and AllowFiles are host rules and files of them to permit only, if any of them is set.
+	Allow      []string `json:"allow,omitempty"`
+	AllowFiles []string `json:"allowFiles,omitempty"`
+	StatusCode int      `json:"statusCode,omitempty"`
+	// BlockPage is a file of the body of block responses.
+	BlockPage   string `json:"blockPage,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// RecorderConfig configures a Recorder.
+type RecorderConfig struct {
+	Dir               string `json:"dir,omitempty"`
+	MaxBodySize       int64  `json:"maxBodySize,omitempty"`
+	MaxEntriesPerFile int    `json:"maxEntriesPerFile,omitempty"`
+	HistorySize       int    `json:"historySize,omitempty"`
+}
+
+// LoadConfig reads a Config from the JSON file, resolving relative paths in it.
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file")
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config file %s", filename)
+	}
+	cfg.resolvePaths(filepath.Dir(filename))
+	return &cfg, nil
+}
+
+func (cfg *Config) resolvePaths(dir string) {
+	resolve := func(name *string) {
+		if *name != "" && !filepath.IsAbs(*name) {
+			*name = filepath.Join(dir, *name)
+		}
+	}
+	if cfg.CA != nil {
+		resolve(&cfg.CA.Cert)
+		resolve(&cfg.CA.Key)
+	}
+	if b := cfg.Blocklist; b != nil {
+		for i := range b.DenyFiles {
+			resolve(&b.DenyFiles[i])
+		}
+		for i := range b.AllowFiles {
+			resolve(&b.AllowFiles[i])
+		}
+		resolve(&b.BlockPage)
+	}
+	if cfg.Recorder != nil {
+		resolve(&cfg.Recorder.Dir)
+	}
+	if cfg.Auth != nil {
+		resolve(&cfg.Auth.Htpasswd)
+	}
+	resolve(&cfg.Mocks)
+	for i := range cfg.MapLocal {
+		resolve(&cfg.MapLocal[i].Path)
+	}
+}
+
+// connectHandler returns a ConnectHandler applying the rules, or nil if there are no rules.
+func (c *HTTPSConfig) connectHandler() (ConnectHandler, error) {
+	if len(c.Rules) == 0 {
+		return nil, nil
+	}
+	lists := make([]*HostList, len(c.Rules))
+	for i, rule := range c.Rules {
+		l, err := NewHostList(rule.Hosts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "HTTPS rule %d", i)
+		}
+		lists[i] = l
+	}
+	rules := c.Rules
+	return func(r *http.Request) ConnectDecision {
+		for i, l := range lists {
+			if l.Match(r.URL.Host) {
+				return ConnectDecision{Action: rules[i].Action.connectAction()}
+			}
+		}
+		// ProxyServer.HTTPSAction is applied, which may be changed after the config is loaded.
+		return ConnectDecision{}
+	}, nil
+}
+
+func loadHostLists(rules, files []string) (*HostList, error) {
+	l, err := NewHostList(rules...)
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range files {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open host list")
+		}
+		fl, err := ParseHostList(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "host list %s", filename)
+		}
+		l.merge(fl)
+	}
+	return l, nil
+}
+
+func (c *BlocklistConfig) blocker() (*Blocker, error) {
+	b := &Blocker{StatusCode: c.StatusCode, ContentType: c.ContentType}
+	var err error
+	if len(c.Deny) > 0 || len(c.DenyFiles) > 0 {
+		if b.Deny, err = loadHostLists(c.Deny, c.DenyFiles); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Allow) > 0 || len(c.AllowFiles) > 0 {
+		if b.Allow, err = loadHostLists(c.Allow, c.AllowFiles); err != nil {
+			return nil, err
+		}
+	}
+	if c.BlockPage != "" {
+		page, err := ioutil.ReadFile(c.BlockPage)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read block page")
+		}
+		b.BlockPage = string(page)
+	}
+	return b, nil
+}
+
+// configFiles returns files referred by cfg, which are watched by ConfigLoader.
+func (cfg *Config) configFiles() []string {
+	var files []string
+	if cfg.CA != nil {
+		files = append(files, cfg.CA.Cert, cfg.CA.Key)
+	}
+	if cfg.Auth != nil && cfg.Auth.Htpasswd != "" {
+		files = append(files, cfg.Auth.Htpasswd)
+	}
+	if b := cfg.Blocklist; b != nil {
+		files = append(files, b.DenyFiles...)
+		files = append(files, b.AllowFiles...)
+		if b.BlockPage != "" {
+			files = append(files, b.BlockPage)
+		}
+	}
+	return files
+}
+
+// Names of middlewares managed by ConfigLoader, from the outermost.
+const (
+	RecorderMiddleware  = "recorder"
+	MocksMiddleware     = "mocks"
+	MapLocalMiddleware  = "maplocal"
+	MapRemoteMiddleware = "mapremote"
+)
+
+var configMiddlewares = []string{RecorderMiddleware, MocksMiddleware, MapLocalMiddleware, MapRemoteMiddleware}
+
+// ConfigLoader applies a config file to a ProxyServer, and reapplies it when the file is changed.
+//
+// It overwrites HTTPSAction, ConnectHandler, CA, UpstreamProxy, ClientACL, Authenticator, DestinationPolicy,
+// ConnectPorts and Blocker of Proxy,
+// and the middlewares named RecorderMiddleware, MocksMiddleware, MapLocalMiddleware and MapRemoteMiddleware,
+// which are inserted to Proxy.Middlewares in this order. Settings missing in the file are cleared.
+// Other settings and established tunnels and MITM sessions are kept on reloading.
+type ConfigLoader struct {
+	// Filename is the config file.
+	Filename string
+	// Proxy is the ProxyServer to configure.
+	Proxy *ProxyServer
+	// Logger logs reloads of the config file.
+	Logger Logger
+	// Override modifies the config read from the file before it's applied, e.g. to apply command-line flags.
+	Override func(*Config)
+
+	mu       sync.Mutex
+	config   *Config
+	modTimes map[string]time.Time
+	recorder *Recorder
+	mocks    *Mocks
+}
+
+func (l *ConfigLoader) log(args ...interface{}) {
+	if l.Logger != nil {
+		l.Logger.Print(args...)
+	}
+}
+
+// Config returns the config applied last, or nil if it's not loaded yet.
+func (l *ConfigLoader) Config() *Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config
+}
+
+// Recorder returns the Recorder configured by the config file, or nil if it's not configured.
+func (l *ConfigLoader) Recorder() *Recorder {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.recorder
+}
+
+// Load reads the config file and applies it to Proxy.
+// If it fails, nothing is changed and the error is returned.
+func (l *ConfigLoader) Load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fi, err := os.Stat(l.Filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to open config file")
+	}
+	cfg, err := LoadConfig(l.Filename)
+	if err != nil {
+		return err
+	}
+	if l.Override != nil {
+		l.Override(cfg)
+	}
+	modTimes := map[string]time.Time{l.Filename: fi.ModTime()}
+	for _, name := range cfg.configFiles() {
+		if fi, err := os.Stat(name); err == nil {
+			modTimes[name] = fi.ModTime()
+		}
+	}
+	return l.apply(cfg, modTimes)
+}
+
+// Apply applies cfg to Proxy instead of the config file. Relative paths in cfg are resolved from the current directory.
+// If it fails, nothing is changed and the error is returned.
+func (l *ConfigLoader) Apply(cfg *Config) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.apply(cfg, l.modTimes)
+}
+
+func (l *ConfigLoader) apply(cfg *Config, modTimes map[string]time.Time) error {
+	if l.Proxy == nil {
+		return errors.New("no proxy server to configure")
+	}
+	connectHandler, err := cfg.HTTPS.connectHandler()
+	if err != nil {
+		return err
+	}
+	var ca *tls.Certificate
+	if cfg.CA != nil {
+		cert, err := tls.LoadX509KeyPair(cfg.CA.Cert, cfg.CA.Key)
+		if err != nil {
+			return errors.Wrap(err, "failed to load CA")
+		}
+		ca = &cert
+	}
+	var upstream *url.URL
+	if cfg.UpstreamProxy != "" {
+		if upstream, err = url.Parse(cfg.UpstreamProxy); err != nil {
+			return errors.Wrap(err, "invalid upstream proxy")
+		}
+	}
+	var acl *ACL
+	if cfg.ClientACL != nil {
+		if acl, err = NewACL(cfg.ClientACL.Allow, cfg.ClientACL.Deny); err != nil {
+			return err
+		}
+	}
+	var auth Authenticator
+	if cfg.Auth != nil {
+		if auth, err = cfg.Auth.authenticator(); err != nil {
+			return err
+		}
+	}
+	var destinations *DestinationPolicy
+	if c := cfg.DestinationPolicy; c != nil {
+		destinations = &DestinationPolicy{}
+		if destinations.Allow, err = ParseCIDRs(c.Allow); err != nil {
+			return err
+		}
+		if destinations.Deny, err = ParseCIDRs(c.Deny); err != nil {
+			return err
+		}
+	}
+	var ports *PortPolicy
+	if cfg.ConnectPorts != nil {
+		pp := *cfg.ConnectPorts
+		ports = &pp
+	}
+	var blocker *Blocker
+	if cfg.Blocklist != nil {
+		if blocker, err = cfg.Blocklist.blocker(); err != nil {
+			return err
+		}
+	}
+	recorder := l.recorder
+	if cfg.Recorder == nil {
+		recorder = nil
+	} else if l.config == nil || l.config.Recorder == nil || *cfg.Recorder != *l.config.Recorder {
+		recorder = &Recorder{
+			Dir:               cfg.Recorder.Dir,
+			MaxBodySize:       cfg.Recorder.MaxBodySize,
+			MaxEntriesPerFile: cfg.Recorder.MaxEntriesPerFile,
+			HistorySize:       cfg.Recorder.HistorySize,
+			Logger:            l.Logger,
+		}
+	}
+	var mocks *Mocks
+	if cfg.Mocks != "" {
+		if mocks, err = LoadMocks(cfg.Mocks); err != nil {
+			return err
+		}
+		mocks.Logger = l.Logger
+	}
+	var mapRemote Middleware
+	if len(cfg.MapRemote) > 0 {
+		if mapRemote, err = MapRemote(cfg.MapRemote...); err != nil {
+			return err
+		}
+	}
+
+	if l.config != nil && cfg.Listen != l.config.Listen {
+		l.log("listen address is changed to ", cfg.Listen, ", which takes effect after restart")
+	}
+	l.Proxy.Reconfigure(func(p *ProxyServer) {
+		p.HTTPSAction = cfg.HTTPS.Action
+		p.ConnectHandler = connectHandler
+		p.CA = ca
+		p.UpstreamProxy = upstream
+		p.ClientACL = acl
+		p.Authenticator = auth
+		p.DestinationPolicy = destinations
+		p.ConnectPorts = ports
+		p.Blocker = blocker
+	})
+	middlewares := map[string]Middleware{}
+	if recorder != nil {
+		middlewares[RecorderMiddleware] = recorder.Middleware()
+	}
+	if mocks != nil {
+		middlewares[MocksMiddleware] = mocks.Middleware()
+	}
+	if len(cfg.MapLocal) > 0 {
+		middlewares[MapLocalMiddleware] = MapLocal(cfg.MapLocal...)
+	}
+	if mapRemote != nil {
+		middlewares[MapRemoteMiddleware] = mapRemote
+	}
+	l.Proxy.Middlewares.setManaged(configMiddlewares, middlewares)
+
+	if l.recorder != nil && l.recorder != recorder {
+		if err := l.recorder.Flush(); err != nil {
+			l.log("failed to flush HAR file: ", err)
+		}
+	}
+	l.config, l.modTimes, l.recorder, l.mocks = cfg, modTimes, recorder, mocks
+	return nil
+}
+
+// stat returns modification times of the config file and files referred by it,
+// and reports whether any of them have been modified since they were loaded.
+func (l *ConfigLoader) stat() (map[string]time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	modTimes := make(map[string]time.Time, len(l.modTimes))
+	changed := false
+	for name, t := range l.modTimes {
+		var mt time.Time
+		if fi, err := os.Stat(name); err == nil {
+			mt = fi.ModTime()
+		}
+		modTimes[name] = mt
+		if !mt.Equal(t) {
+			changed = true
+		}
+	}
+	return modTimes, changed
+}
+
+// Watch reloads the config file when it receives SIGHUP, or the file or files referred by it are modified.
+// The files are checked every interval, and the mock file is reloaded separately when it's modified.
+// Failures of reloading are logged and the current config is kept. Call stop to stop watching.
+func (l *ConfigLoader) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		// the files keep being modified until they are fixed, so the same failure is logged once.
+		var failed map[string]time.Time
+		var mocksErr string
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				if err := l.Load(); err != nil {
+					l.log("failed to reload config: ", err)
+				} else {
+					l.log("reloaded config from ", l.Filename)
+				}
+				continue
+			case <-ticker.C:
+			}
+			if modTimes, changed := l.stat(); changed {
+				if reflect.DeepEqual(modTimes, failed) {
+					continue
+				}
+				if err := l.Load(); err != nil {
+					l.log("failed to reload config: ", err)
+					failed = modTimes
+				} else {
+					l.log("reloaded config from ", l.Filename)
+					failed = nil
+				}
+				continue
+			}
+			l.mu.Lock()
+			mocks := l.mocks
+			l.mu.Unlock()
+			if mocks == nil || !mocks.changed() {
+				continue
+			}
+			if err := mocks.Reload(); err != nil {
+				if err.Error() != mocksErr {
+					l.log("failed to reload mocks: ", err)
+					mocksErr = err.Error()
+				}
+				continue
+			}
+			mocksErr = ""
+			l.log("reloaded mocks from ", mocks.Filename)
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,410 @@
+package groxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// ConnKind is a kind of connections hijacked for CONNECT requests.
+type ConnKind int
+
+const (
+	// ConnKindTunnel is a tunnel that relays bytes between the client and the destination server.
+	ConnKindTunnel ConnKind = iota
+	// ConnKindMITM is a session that decrypts HTTPS requests from the client.
+	ConnKindMITM
+)
+
+func (k ConnKind) String() string {
+	switch k {
+	case ConnKindTunnel:
+		return "tunnel"
+	case ConnKindMITM:
+		return "mitm"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnInfo describes an active hijacked connection.
+type ConnInfo struct {
+	ID         uint64
+	Kind       ConnKind
+	ClientAddr string
+	// Host is the target of the CONNECT request.
+	Host string
+	// Redirect is the "host:port" that ConnectHandler redirected the connection to, if any.
+	Redirect string
+	Start    time.Time
+	// BytesIn is the number of bytes received from the client.
+	BytesIn int64
+	// BytesOut is the number of bytes sent to the client.
+	BytesOut int64
+	// Requests is the number of requests served by a MITM session.
+	Requests int64
+}
+
+// hijackedConn is a client connection hijacked for a CONNECT request.
+// It closes the connection (and the upstream connection if it's a tunnel) when timeouts expire.
+type hijackedConn struct {
+	p        *ProxyServer
+	id       uint64
+	kind     ConnKind
+	host     string
+	start    time.Time
+	client   net.Conn
+	upstream net.Conn
+	redirect string // destination instead of host
+
+	// accessed atomically
+	lastActive int64 // unix nano
+	bytesIn    int64
+	bytesOut   int64
+	requests   int64
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	mu       sync.Mutex
+	lifetime *time.Timer
+	busy     bool // a MITM request is in flight
+	draining bool
+}
+
+// newHijackedConn creates a hijackedConn and registers it to p.
+// The client connection is wrapped to count transferred bytes, so use c.client instead of the given one.
+// If p is shutting down, it closes the connections and returns nil.
+func (p *ProxyServer) newHijackedConn(kind ConnKind, host, redirect string, client, upstream net.Conn) *hijackedConn {
+	c := &hijackedConn{
+		p:        p,
+		kind:     kind,
+		host:     host,
+		redirect: redirect,
+		start:    time.Now(),
+		upstream: upstream,
+		done:     make(chan struct{}),
+	}
+	c.client = &countingConn{Conn: client, in: &c.bytesIn, out: &c.bytesOut}
+	if !p.trackConn(c) {
+		c.close("shutdown")
+		return nil
+	}
+	if p.OnTunnelOpen != nil {
+		p.OnTunnelOpen(c.info())
+	}
+	c.touch()
+	if p.MaxConnLifetime > 0 {
+		c.mu.Lock()
+		c.lifetime = time.AfterFunc(p.MaxConnLifetime, func() { c.close("lifetime exceeded") })
+		c.mu.Unlock()
+	}
+	return c
+}
+
+func (c *hijackedConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func (c *hijackedConn) info() ConnInfo {
+	return ConnInfo{
+		ID:         c.id,
+		Kind:       c.kind,
+		ClientAddr: c.client.RemoteAddr().String(),
+		Host:       c.host,
+		Redirect:   c.redirect,
+		Start:      c.start,
+		BytesIn:    atomic.LoadInt64(&c.bytesIn),
+		BytesOut:   atomic.LoadInt64(&c.bytesOut),
+		Requests:   atomic.LoadInt64(&c.requests),
+	}
+}
+
+func (c *hijackedConn) idle() bool {
+	last := time.Unix(0, atomic.LoadInt64(&c.lastActive))
+	return time.Since(last) >= c.p.IdleTimeout
+}
+
+// close closes the connections. Only the first call takes effect, and its reason is logged.
+func (c *hijackedConn) close(reason string) {
+	c.closeOnce.Do(func() {
+		c.p.log("closing connection to ", c.host, ": ", reason)
+		c.mu.Lock()
+		if c.lifetime != nil {
+			c.lifetime.Stop()
+		}
+		c.mu.Unlock()
+		c.client.Close()
+		if c.upstream != nil {
+			c.upstream.Close()
+		}
+		c.p.untrackConn(c)
+		// Shutdown waits for done, so the hook is called before it.
+		if c.id != 0 && c.p.OnTunnelClose != nil {
+			c.p.OnTunnelClose(c.info())
+		}
+		close(c.done)
+	})
+}
+
+// setBusy marks whether a MITM request is in flight.
+// It returns false if the connection should not serve more requests because of shutdown.
+func (c *hijackedConn) setBusy(busy bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy = busy
+	return !c.draining
+}
+
+func (c *hijackedConn) isDraining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
+// drain closes the connection if it's an idle MITM session,
+// and makes a busy one to be closed after its in-flight request.
+// Tunnels are left as they are because the proxy cannot know where their streams end.
+func (c *hijackedConn) drain() {
+	if c.upstream != nil {
+		return
+	}
+	c.mu.Lock()
+	c.draining = true
+	busy := c.busy
+	c.mu.Unlock()
+	if !busy {
+		c.close("shutdown")
+	}
+}
+
+func (p *ProxyServer) trackConn(c *hijackedConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shuttingDown {
+		return false
+	}
+	if p.conns == nil {
+		p.conns = make(map[uint64]*hijackedConn)
+	}
+	p.lastConnID++
+	c.id = p.lastConnID
+	p.conns[c.id] = c
+	return true
+}
+
+func (p *ProxyServer) untrackConn(c *hijackedConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, c.id)
+}
+
+// Connections returns active CONNECT tunnels and MITM sessions, sorted by their IDs.
+func (p *ProxyServer) Connections() []ConnInfo {
+	p.mu.Lock()
+	infos := make([]ConnInfo, 0, len(p.conns))
+	for _, c := range p.conns {
+		infos = append(infos, c.info())
+	}
+	p.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseConnection closes the active tunnel or MITM session identified by id.
+func (p *ProxyServer) CloseConnection(id uint64) error {
+	p.mu.Lock()
+	c, ok := p.conns[id]
+	p.mu.Unlock()
+	if !ok {
+		return errors.Errorf("connection %d not found", id)
+	}
+	c.close("closed by operator")
+	return nil
+}
+
+func (p *ProxyServer) isShuttingDown() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.shuttingDown
+}
+
+// Shutdown gracefully closes hijacked connections of p.
+// It stops accepting new CONNECT requests, closes MITM sessions after their in-flight requests complete,
+// and waits for tunnels to be closed by peers.
+// If ctx expires first, remaining connections are closed forcibly and ctx's error is returned.
+//
+// Hijacked connections are not tracked by http.Server, so call both of http.Server.Shutdown and Shutdown
+// (e.g. using http.Server.RegisterOnShutdown) to shut down the whole proxy.
+func (p *ProxyServer) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.shuttingDown = true
+	conns := make([]*hijackedConn, 0, len(p.conns))
+	for _, c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.drain()
+	}
+	for _, c := range conns {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			for _, c := range conns {
+				c.close("shutdown")
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// tunnel pipes the client and upstream connections until both directions finish.
+func (c *hijackedConn) tunnel() {
+	errc := make(chan error, 2)
+	go func() { errc <- c.pipe(c.upstream, c.client) }()
+	go func() { errc <- c.pipe(c.client, c.upstream) }()
+	reason := "connection closed"
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil && reason == "connection closed" {
+			reason = "failed to pipe connections: " + err.Error()
+		}
+	}
+	c.close(reason)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// requestContext returns a context of a MITM request, which is cancelled when c is closed.
+func (c *hijackedConn) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// watchClient closes c if the client disconnects while a MITM request is in flight, which cancels the request.
+// The request body is read from r, so it starts peeking r after body is closed.
+// Call the returned stop before reading the next request from r.
+func (c *hijackedConn) watchClient(rawCli *tls.Conn, r *bufio.Reader, body <-chan struct{}) (stop func()) {
+	quit := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-body:
+		case <-quit:
+			return
+		}
+		if _, err := r.Peek(1); err != nil {
+			select {
+			case <-quit:
+				// aborted by stop.
+			default:
+				c.close("client disconnected")
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		rawCli.SetReadDeadline(time.Now())
+		<-exited
+		rawCli.SetReadDeadline(time.Time{})
+	}
+}
+
+// closeNotifyBody is a request body that closes closed when it's closed.
+type closeNotifyBody struct {
+	io.ReadCloser
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (b *closeNotifyBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { close(b.closed) })
+	return err
+}
+
+// countingConn counts bytes read from and written to the underlying connection.
+type countingConn struct {
+	net.Conn
+	in, out *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.in, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.out, int64(n))
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *hijackedConn) pipe(dst, src net.Conn) error {
+	buf := make([]byte, 32*1024)
+	for {
+		if c.p.IdleTimeout > 0 {
+			src.SetReadDeadline(time.Now().Add(c.p.IdleTimeout))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			c.touch()
+			if c.p.IdleTimeout > 0 {
+				dst.SetWriteDeadline(time.Now().Add(c.p.IdleTimeout))
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if err == io.EOF {
+			if cw, ok := dst.(closeWriter); ok {
+				cw.CloseWrite()
+			}
+			return nil
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// the other direction may still be active.
+			if !c.idle() {
+				continue
+			}
+			c.close("idle timeout")
+		}
+		return err
+	}
+}
@@ -0,0 +1,351 @@
+package groxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type recordLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *recordLogger) Print(args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprint(args...))
+}
+
+func (l *recordLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, log := range l.logs {
+		if strings.Contains(log, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// connect sends a CONNECT request for host to the proxy server, and returns the connection and its response.
+func connect(t *testing.T, proxyserver *httptest.Server, host string) (net.Conn, *http.Response) {
+	conn, err := net.Dial("tcp", proxyserver.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect the proxy server: %v", err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read CONNECT response: %v", err)
+	}
+	return conn, resp
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	logger := &recordLogger{}
+	proxy := ProxyServer{Logger: logger, IdleTimeout: 100 * time.Millisecond}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	conn, _ := connect(t, proxyserver, ln.Addr().String())
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the tunnel is closed, but it's still alive")
+	}
+	if !logger.contains("idle timeout") {
+		t.Errorf("expected closing reason %q is logged, but got %v", "idle timeout", logger.logs)
+	}
+}
+
+func TestMITMLifetime(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	logger := &recordLogger{}
+	proxy := ProxyServer{Logger: logger, HTTPSAction: HTTPSActionMITM, MaxConnLifetime: 100 * time.Millisecond}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	conn, _ := connect(t, proxyserver, ts.Listener.Addr().String())
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the MITM session is closed, but it's still alive")
+	}
+	if !logger.contains("lifetime exceeded") {
+		t.Errorf("expected closing reason %q is logged, but got %v", "lifetime exceeded", logger.logs)
+	}
+}
+
+func TestShutdownClosesTunnels(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	var proxy ProxyServer
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	conn, _ := connect(t, proxyserver, ln.Addr().String())
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected shutdown error is %v, but got %v", context.DeadlineExceeded, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the tunnel is closed, but it's still alive")
+	}
+
+	conn2, resp := connect(t, proxyserver, ln.Addr().String())
+	defer conn2.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status code is %v, but got %v", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestShutdownDrainsMITM(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	var closed int32
+	var proxy ProxyServer
+	proxy.HTTPSAction = HTTPSActionMITM
+	proxy.OnTunnelClose = func(ConnInfo) { atomic.StoreInt32(&closed, 1) }
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	conn, _ := connect(t, proxyserver, ts.Listener.Addr().String())
+	defer conn.Close()
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("failed to handshake: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Errorf("failed to shutdown: %v", err)
+	}
+	if atomic.LoadInt32(&closed) == 0 {
+		t.Errorf("expected OnTunnelClose is called before Shutdown returns, but it's not")
+	}
+	tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := tlsConn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the MITM session is closed, but it's still alive")
+	}
+}
+
+func TestShutdownWithInFlightMITMRequest(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer ts.Close()
+
+	var proxy ProxyServer
+	proxy.HTTPSAction = HTTPSActionMITM
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	conn, _ := connect(t, proxyserver, ts.Listener.Addr().String())
+	defer conn.Close()
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", ts.Listener.Addr().String())
+	<-received
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- proxy.Shutdown(ctx)
+	}()
+	close(release)
+
+	tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("expected the in-flight request completes, but got %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "done" {
+		t.Errorf("expected response body is %q, but got %q", "done", string(body))
+	}
+	if !resp.Close {
+		t.Errorf("expected the response closes the MITM session, but it doesn't")
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("failed to shutdown: %v", err)
+	}
+}
+
+func TestConnectionRegistry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 5)
+				conn.Read(buf)
+				conn.Write(buf)
+			}()
+		}
+	}()
+
+	var proxy ProxyServer
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	conn, _ := connect(t, proxyserver, ln.Addr().String())
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("failed to read from the tunnel: %v", err)
+	}
+
+	conns := proxy.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("expected %d active connection, but got %v", 1, conns)
+	}
+	info := conns[0]
+	if info.Kind != ConnKindTunnel || info.Host != ln.Addr().String() || info.ClientAddr != conn.LocalAddr().String() {
+		t.Errorf("unexpected connection info: %+v", info)
+	}
+	if info.BytesIn != 5 {
+		t.Errorf("expected received bytes are %d, but got %d", 5, info.BytesIn)
+	}
+
+	if err := proxy.CloseConnection(info.ID); err != nil {
+		t.Fatalf("failed to close the connection: %v", err)
+	}
+	if conns := proxy.Connections(); len(conns) != 0 {
+		t.Errorf("expected no active connections, but got %v", conns)
+	}
+	if err := proxy.CloseConnection(info.ID); err == nil {
+		t.Errorf("expected closing an unknown connection fails, but it succeeded")
+	}
+}
+
+func TestConnectHandlerAndTunnelCallbacks(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 5)
+				conn.Read(buf)
+				conn.Write(buf)
+			}()
+		}
+	}()
+
+	opened := make(chan ConnInfo, 1)
+	closed := make(chan ConnInfo, 1)
+	proxy := ProxyServer{
+		HTTPSAction: HTTPSActionReject,
+		ConnectHandler: func(r *http.Request) ConnectDecision {
+			if r.URL.Host == "default.test:443" {
+				// HTTPSAction is applied without Action.
+				return ConnectDecision{Host: ln.Addr().String()}
+			}
+			return ConnectDecision{Action: ConnectProxy, Host: ln.Addr().String()}
+		},
+		OnTunnelOpen:  func(info ConnInfo) { opened <- info },
+		OnTunnelClose: func(info ConnInfo) { closed <- info },
+	}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	conn, resp := connect(t, proxyserver, "default.test:443")
+	conn.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status code is %v, but got %v", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	conn, resp = connect(t, proxyserver, "redirected.test:443")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code is %v, but got %v", http.StatusOK, resp.StatusCode)
+	}
+	if info := <-opened; info.Host != "redirected.test:443" || info.Redirect != ln.Addr().String() {
+		t.Errorf("expected the tunnel to redirected.test:443 is redirected to %s, but got %s to %s", ln.Addr().String(), info.Host, info.Redirect)
+	}
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected echo %q, but got %q (%v)", "hello", string(buf), err)
+	}
+	conn.Close()
+
+	select {
+	case info := <-closed:
+		if info.BytesIn != 5 || info.BytesOut != 5 {
+			t.Errorf("expected transferred bytes are 5 in and 5 out, but got %d in and %d out", info.BytesIn, info.BytesOut)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected OnTunnelClose is called, but it's not")
+	}
+}
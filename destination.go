@@ -0,0 +1,145 @@
+package groxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// blockedNetworks are networks that DestinationPolicy blocks by default.
+var blockedNetworks, _ = ParseCIDRs([]string{
+	"0.0.0.0/8",       // "this" network
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // carrier-grade NAT
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link-local
+	"169.254.169.254", // cloud metadata services
+	"172.16.0.0/12",   // private
+	"192.168.0.0/16",  // private
+	"198.18.0.0/15",   // benchmarking
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved and broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b::/96",    // NAT64, which reaches IPv4 addresses including private ones
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link-local
+	"ff00::/8",        // multicast
+})
+
+// DestinationPolicy restricts destination servers that the proxy connects to.
+// It blocks loopback, link-local, private, multicast and cloud metadata addresses.
+// Host names are resolved by the policy itself and only the checked addresses are dialed,
+// so DNS rebinding cannot bypass it.
+//
+// When ProxyServer.Transport is set, it must dial via ProxyServer.DialContext to respect the policy,
+// and must not send requests via upstream proxies.
+//
+// Requests and tunnels via ProxyServer.UpstreamProxy (or proxies set by environment variables) are checked
+// before they are sent, and all addresses of their destination hosts must be permitted.
+// The upstream proxy resolves the hosts again, so DNS rebinding is not prevented for them.
+// Upstream proxies themselves are chosen by the operator and may be on private networks, so they are not restricted.
+type DestinationPolicy struct {
+	// Allow lists networks exempted from blocking.
+	Allow []*net.IPNet
+	// Deny lists networks blocked in addition to the default ones.
+	Deny []*net.IPNet
+	// Resolver resolves host names. If it's nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+}
+
+// DestinationError is returned when a destination is blocked by DestinationPolicy.
+type DestinationError struct {
+	Host string
+}
+
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("destination %s is not allowed", e.Host)
+}
+
+func isDestinationError(err error) bool {
+	_, ok := errors.Cause(err).(*DestinationError)
+	return ok
+}
+
+// Permits reports whether the proxy may connect to ip.
+func (d *DestinationPolicy) Permits(ip net.IP) bool {
+	if containsIP(d.Allow, ip) {
+		return true
+	}
+	return !containsIP(blockedNetworks, ip) && !containsIP(d.Deny, ip)
+}
+
+func (d *DestinationPolicy) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// check returns an error unless all addresses of host are permitted.
+// It's used for destinations connected by upstream proxies, which cannot be restricted to the checked addresses.
+func (d *DestinationPolicy) check(ctx context.Context, host string) error {
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !d.Permits(ip) {
+			return &DestinationError{Host: host}
+		}
+	}
+	return nil
+}
+
+// resolve returns permitted addresses of host.
+func (d *DestinationPolicy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	permitted := ips[:0]
+	for _, ip := range ips {
+		if d.Permits(ip) {
+			permitted = append(permitted, ip)
+		}
+	}
+	if len(permitted) == 0 {
+		return nil, &DestinationError{Host: host}
+	}
+	return permitted, nil
+}
+
+// dial connects to one of the permitted addresses of addr.
+func (d *DestinationPolicy) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,142 @@
+package groxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDestinationPolicyPermits(t *testing.T) {
+	deny, _ := ParseCIDRs([]string{"203.0.113.0/24"})
+	allow, _ := ParseCIDRs([]string{"10.1.2.3"})
+	policy := &DestinationPolicy{Allow: allow, Deny: deny}
+	cases := []struct {
+		ip       string
+		expected bool
+	}{
+		{"93.184.216.34", true},
+		{"127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"10.1.2.3", true},
+		{"172.16.5.4", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"203.0.113.7", false},
+		{"100.64.1.1", false},
+		{"198.18.0.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"64:ff9b::a00:1", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"2606:2800:220:1::1", true},
+	}
+	for _, c := range cases {
+		if got := policy.Permits(net.ParseIP(c.ip)); got != c.expected {
+			t.Errorf("expected Permits(%s) is %v, but got %v", c.ip, c.expected, got)
+		}
+	}
+}
+
+func TestBlockPrivateDestination(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	var proxy ProxyServer
+	proxy.DestinationPolicy = &DestinationPolicy{}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status code is %v, but got %v", http.StatusForbidden, resp.StatusCode)
+	}
+
+	for _, action := range []HTTPSAction{HTTPSActionProxy, HTTPSActionMITM} {
+		proxy.HTTPSAction = action
+		conn, resp := connect(t, proxyserver, ts.Listener.Addr().String())
+		conn.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status code of CONNECT is %v, but got %v (action %v)", http.StatusForbidden, resp.StatusCode, action)
+		}
+	}
+
+	proxy.DestinationPolicy.Allow, _ = ParseCIDRs([]string{"127.0.0.1"})
+	resp, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status code is %v, but got %v", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestDestinationPolicyWithUpstreamProxy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	// the upstream proxy answers by itself, so that public destinations are not connected actually.
+	upstreamserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "CONNECT" {
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte("upstream"))
+	}))
+	defer upstreamserver.Close()
+	upstreamurl, _ := url.Parse(upstreamserver.URL)
+
+	// the upstream proxy is on the loopback address, but it's dialed regardless of the policy.
+	proxy := ProxyServer{UpstreamProxy: upstreamurl, DestinationPolicy: &DestinationPolicy{}}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, _ := url.Parse(proxyserver.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+
+	cases := []struct {
+		url      string
+		expected int
+	}{
+		{"http://93.184.216.34/", http.StatusOK},
+		{ts.URL, http.StatusForbidden},
+		{"http://10.0.0.1/", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		resp, err := client.Get(c.url)
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.expected {
+			t.Errorf("%s: expected status code is %v, but got %v", c.url, c.expected, resp.StatusCode)
+		}
+	}
+
+	for _, c := range []struct {
+		host     string
+		expected int
+	}{
+		{"93.184.216.34:443", http.StatusOK},
+		{"10.0.0.1:443", http.StatusForbidden},
+	} {
+		conn, resp := connect(t, proxyserver, c.host)
+		conn.Close()
+		if resp.StatusCode != c.expected {
+			t.Errorf("%s: expected status code of CONNECT is %v, but got %v", c.host, c.expected, resp.StatusCode)
+		}
+	}
+}
@@ -121,3 +121,16 @@ func ExampleProxyServer_Use_mitm() {
 	// original request: message!
 	// response: hijack!
 }
+
+func ExampleOnResponse() {
+	var p ProxyServer
+	// add a header to responses from example.com.
+	p.Use(OnResponse(func(resp *http.Response) *http.Response {
+		resp.Header.Set("X-Proxied-By", "groxy")
+		return resp
+	}, Host("*.example.com")))
+	// respond a stub without requesting the server.
+	p.Use(OnRequest(func(req *http.Request) (*http.Request, *http.Response) {
+		return nil, NewResponse(req, http.StatusOK, "application/json", []byte(`{"stub": true}`))
+	}, Method("GET"), PathPrefix("/api/")))
+}
@@ -0,0 +1,107 @@
+package groxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Flow describes a proxied request and its response.
+// Every Middleware can get the Flow of a request by FlowFromContext(req.Context()),
+// and the Flow of a response by FlowFromContext(resp.Request.Context()).
+type Flow struct {
+	// ID identifies the flow uniquely.
+	ID string
+	// ConnID is the ID of the MITM session that the flow belongs to (see ProxyServer.Connections).
+	// It's zero for plain HTTP requests.
+	ConnID uint64
+	// ClientAddr is the address of the client.
+	ClientAddr string
+	// User is the user authenticated by ProxyServer.Authenticator.
+	User string
+	// ConnectHost is the target of the CONNECT request of the MITM session.
+	ConnectHost string
+	// TLS is the state of the TLS connection with the client of the MITM session.
+	TLS *tls.ConnectionState
+
+	mu       sync.Mutex
+	timings  FlowTimings
+	userData map[string]interface{}
+}
+
+// FlowTimings records when a flow progressed.
+type FlowTimings struct {
+	// Start is when the proxy received the request.
+	Start time.Time
+	// ResponseStart is when the middlewares returned the response.
+	ResponseStart time.Time
+	// End is when the proxy finished sending the response to the client.
+	End time.Time
+}
+
+func newFlowID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newFlow creates a Flow of r, which has the client address and the context of the proxy request.
+func newFlow(r *http.Request) *Flow {
+	f := &Flow{
+		ID:         newFlowID(),
+		ClientAddr: r.RemoteAddr,
+		timings:    FlowTimings{Start: time.Now()},
+	}
+	f.User, _ = UserFromContext(r.Context())
+	return f
+}
+
+// FlowFromContext returns the Flow stored in ctx, or nil if there is no Flow.
+func FlowFromContext(ctx context.Context) *Flow {
+	f, _ := ctx.Value(flowContextKey).(*Flow)
+	return f
+}
+
+func withFlow(ctx context.Context, f *Flow) context.Context {
+	return context.WithValue(ctx, flowContextKey, f)
+}
+
+// Timings returns when f progressed. Zero values mean f has not reached the phase yet.
+func (f *Flow) Timings() FlowTimings {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.timings
+}
+
+func (f *Flow) markResponseStart() {
+	f.mu.Lock()
+	f.timings.ResponseStart = time.Now()
+	f.mu.Unlock()
+}
+
+func (f *Flow) markEnd() {
+	f.mu.Lock()
+	f.timings.End = time.Now()
+	f.mu.Unlock()
+}
+
+// Set stores a value associated with key, to share it among middlewares handling f.
+func (f *Flow) Set(key string, value interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.userData == nil {
+		f.userData = make(map[string]interface{})
+	}
+	f.userData[key] = value
+}
+
+// Get returns the value associated with key, or nil if there is no such value.
+func (f *Flow) Get(key string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.userData[key]
+}
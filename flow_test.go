@@ -0,0 +1,66 @@
+package groxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFlowSharedAcrossMiddlewares(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	var proxy ProxyServer
+	proxy.HTTPSAction = HTTPSActionMITM
+	proxy.Use(OnRequest(func(req *http.Request) (*http.Request, *http.Response) {
+		FlowFromContext(req.Context()).Set("path", req.URL.Path)
+		return req, nil
+	}))
+	flows := make(chan *Flow, 2)
+	proxy.Use(OnResponse(func(resp *http.Response) *http.Response {
+		flows <- FlowFromContext(resp.Request.Context())
+		return resp
+	}))
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyurl),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	for _, path := range []string{"/first", "/second"} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	first, second := <-flows, <-flows
+	if first == nil || second == nil {
+		t.Fatalf("expected flows are available to middlewares, but got %v and %v", first, second)
+	}
+	if first.ID == second.ID {
+		t.Errorf("expected flow IDs are unique, but both are %q", first.ID)
+	}
+	if first.ConnID == 0 || first.ConnID != second.ConnID {
+		t.Errorf("expected flows share the MITM connection, but got %d and %d", first.ConnID, second.ConnID)
+	}
+	if first.ConnectHost != ts.Listener.Addr().String() || first.TLS == nil {
+		t.Errorf("expected MITM details are recorded, but got host %q and TLS %v", first.ConnectHost, first.TLS)
+	}
+	if got := first.Get("path"); got != "/first" {
+		t.Errorf("expected user data is %q, but got %v", "/first", got)
+	}
+	if timings := first.Timings(); timings.Start.IsZero() || timings.ResponseStart.Before(timings.Start) {
+		t.Errorf("unexpected timings: %+v", timings)
+	}
+}
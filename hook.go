@@ -0,0 +1,61 @@
+package groxy
+
+import "net/http"
+
+// RequestHook inspects or modifies a request before it's sent to the target server.
+// It returns the request to send, or a non-nil response to return it without sending the request.
+type RequestHook func(*http.Request) (*http.Request, *http.Response)
+
+// ResponseHook inspects or modifies a response, and returns the response to return.
+// If it returns nil, resp is returned as it is. resp.Request is the request of the response.
+// If it returns another response, resp.Body is closed unless the returned response has the same Body.
+type ResponseHook func(resp *http.Response) *http.Response
+
+// OnRequest returns a Middleware that calls hook for requests matching all of ms.
+func OnRequest(hook RequestHook, ms ...Matcher) Middleware {
+	cond := All(ms...)
+	return func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			if !cond(req) {
+				return h(req)
+			}
+			newreq, resp := hook(req)
+			if resp != nil {
+				if resp.Request == nil {
+					resp.Request = req
+				}
+				return resp, nil
+			}
+			if newreq != nil {
+				req = newreq
+			}
+			return h(req)
+		}
+	}
+}
+
+// OnResponse returns a Middleware that calls hook for responses of requests matching all of ms.
+// Requests failed with errors are not passed to hook.
+func OnResponse(hook ResponseHook, ms ...Matcher) Middleware {
+	cond := All(ms...)
+	return func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			resp, err := h(req)
+			if err != nil || !cond(req) {
+				return resp, err
+			}
+			if resp.Request == nil {
+				resp.Request = req
+			}
+			newresp := hook(resp)
+			if newresp == nil {
+				return resp, nil
+			}
+			if newresp.Body != resp.Body && resp.Body != nil {
+				// the original body is not returned, so it's closed to release the connection.
+				resp.Body.Close()
+			}
+			return newresp, nil
+		}
+	}
+}
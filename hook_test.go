@@ -0,0 +1,145 @@
+package groxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestAndResponseHooks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+
+	var proxy ProxyServer
+	// the outermost hook sees short-circuit responses as well.
+	proxy.Use(OnResponse(func(resp *http.Response) *http.Response {
+		resp.Header.Set("X-Hooked", resp.Request.URL.Path)
+		return resp
+	}, Method("GET")))
+	proxy.Use(OnRequest(func(req *http.Request) (*http.Request, *http.Response) {
+		return nil, NewResponse(req, http.StatusTeapot, "text/plain", []byte("short-circuit"))
+	}, PathPrefix("/mock/")))
+	proxy.Use(OnRequest(func(req *http.Request) (*http.Request, *http.Response) {
+		req.URL.Path = "/rewritten"
+		return req, nil
+	}, PathPrefix("/rewrite")))
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+
+	cases := []struct {
+		path   string
+		code   int
+		body   string
+		hooked string
+	}{
+		{"/mock/a", http.StatusTeapot, "short-circuit", "/mock/a"},
+		{"/rewrite", http.StatusOK, "/rewritten", "/rewritten"},
+		{"/other", http.StatusOK, "/other", "/other"},
+	}
+	for _, c := range cases {
+		resp, err := client.Get(ts.URL + c.path)
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.code || string(body) != c.body {
+			t.Errorf("%s: expected response is %v %q, but got %v %q", c.path, c.code, c.body, resp.StatusCode, string(body))
+		}
+		if got := resp.Header.Get("X-Hooked"); got != c.hooked {
+			t.Errorf("%s: expected X-Hooked is %q, but got %q", c.path, c.hooked, got)
+		}
+	}
+}
+
+func TestNilResponses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	var proxy ProxyServer
+	proxy.Use(When(PathPrefix("/broken"), func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			return nil, nil
+		}
+	}))
+	proxy.Use(OnResponse(func(resp *http.Response) *http.Response {
+		return nil
+	}))
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+
+	cases := []struct {
+		path string
+		code int
+	}{
+		// the hook returning nil keeps the original response.
+		{"/", http.StatusOK},
+		{"/broken", http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		resp, err := client.Get(ts.URL + c.path)
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("%s: expected status code is %v, but got %v", c.path, c.code, resp.StatusCode)
+		}
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestOnResponseClosesReplacedBody(t *testing.T) {
+	var original *closeRecorder
+	base := func(req *http.Request) (*http.Response, error) {
+		original = &closeRecorder{Reader: strings.NewReader("original")}
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: original, Request: req}, nil
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+
+	replace := OnResponse(func(resp *http.Response) *http.Response {
+		return NewResponse(resp.Request, http.StatusOK, "text/plain", []byte("replaced"))
+	})
+	resp, _ := replace(base)(req)
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "replaced" || !original.closed {
+		t.Errorf("expected the replaced response is returned and the original body is closed, but got %q (closed: %v)", body, original.closed)
+	}
+
+	// a copy of the response shares the body, which must not be closed.
+	modify := OnResponse(func(resp *http.Response) *http.Response {
+		newresp := *resp
+		newresp.StatusCode = http.StatusAccepted
+		return &newresp
+	})
+	resp, _ = modify(base)(req)
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "original" || original.closed {
+		t.Errorf("expected the shared body is kept open, but got %q (closed: %v)", body, original.closed)
+	}
+}
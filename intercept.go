@@ -0,0 +1,394 @@
+package groxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrDropped is returned by the Middleware of Interceptor for flows dropped by operators.
+// Dropped proxy requests get http.StatusBadGateway, and MITM sessions of dropped requests are closed.
+var ErrDropped = errors.New("dropped by interceptor")
+
+const defaultInterceptTimeout = 5 * time.Minute
+
+// InterceptPhase is a phase of a flow when it's held.
+type InterceptPhase string
+
+const (
+	// InterceptRequest holds requests before they are sent to target servers.
+	InterceptRequest InterceptPhase = "request"
+	// InterceptResponse holds responses before they are returned to clients.
+	InterceptResponse InterceptPhase = "response"
+)
+
+// Intercepted is a snapshot of a held request or response. It's also used to edit them on resuming.
+type Intercepted struct {
+	// ID identifies the held flow in the Interceptor.
+	ID string `json:"id"`
+	// FlowID is the ID of the Flow.
+	FlowID string         `json:"flowId,omitempty"`
+	Phase  InterceptPhase `json:"phase"`
+	// Since is when it's held.
+	Since time.Time `json:"since"`
+
+	// Method and URL are of the request. They are editable in InterceptRequest.
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Status is the status code of the response in InterceptResponse.
+	Status int `json:"status,omitempty"`
+	// Header is of the request in InterceptRequest, or of the response in InterceptResponse.
+	Header http.Header `json:"header"`
+	// Body is of the request in InterceptRequest, or of the response in InterceptResponse.
+	Body string `json:"body"`
+	// BodyEncoding is "base64" if Body is encoded because it's binary.
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+}
+
+type interceptDecision struct {
+	edit *Intercepted
+	drop bool
+}
+
+type heldFlow struct {
+	snapshot Intercepted
+	decision chan interceptDecision
+}
+
+// Interceptor holds requests and responses matching its matchers until operators resume or drop them.
+// Held flows can be inspected and edited through its methods or Handler.
+//
+//	ic := &groxy.Interceptor{Request: groxy.Host("api.example.com")}
+//	p.Use(ic.Middleware())
+type Interceptor struct {
+	// Request matches requests to hold before they are sent. If it's nil, no requests are held.
+	Request Matcher
+	// Response matches requests whose responses are held before they are returned. If it's nil, no responses are held.
+	Response Matcher
+	// Timeout resumes held flows without changes after the duration, or drops them if DropOnTimeout is true.
+	// If it's zero, 5 minutes is used.
+	Timeout       time.Duration
+	DropOnTimeout bool
+	// OnHold is called when a flow is held, e.g. to notify operators.
+	OnHold func(Intercepted)
+
+	mu     sync.Mutex
+	lastID uint64
+	held   map[string]*heldFlow
+}
+
+// Middleware returns a Middleware that holds matching requests and responses.
+func (ic *Interceptor) Middleware() Middleware {
+	return func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			if ic.Request != nil && ic.Request(req) {
+				var err error
+				if req, err = ic.holdRequest(req); err != nil {
+					return nil, err
+				}
+			}
+			resp, err := h(req)
+			if err != nil {
+				return nil, err
+			}
+			if ic.Response != nil && ic.Response(req) {
+				return ic.holdResponse(req, resp)
+			}
+			return resp, nil
+		}
+	}
+}
+
+func (ic *Interceptor) timeout() time.Duration {
+	if ic.Timeout == 0 {
+		return defaultInterceptTimeout
+	}
+	return ic.Timeout
+}
+
+// hold waits for the decision on the snapshot, and returns the edited snapshot.
+func (ic *Interceptor) hold(req *http.Request, snapshot Intercepted) (*Intercepted, error) {
+	ic.mu.Lock()
+	if ic.held == nil {
+		ic.held = make(map[string]*heldFlow)
+	}
+	ic.lastID++
+	snapshot.ID = strconv.FormatUint(ic.lastID, 10)
+	snapshot.Since = time.Now()
+	if flow := FlowFromContext(req.Context()); flow != nil {
+		snapshot.FlowID = flow.ID
+	}
+	hf := &heldFlow{snapshot: snapshot, decision: make(chan interceptDecision, 1)}
+	ic.held[snapshot.ID] = hf
+	ic.mu.Unlock()
+	defer func() {
+		ic.mu.Lock()
+		delete(ic.held, snapshot.ID)
+		ic.mu.Unlock()
+	}()
+	if ic.OnHold != nil {
+		ic.OnHold(snapshot)
+	}
+
+	timer := time.NewTimer(ic.timeout())
+	defer timer.Stop()
+	select {
+	case d := <-hf.decision:
+		if d.drop {
+			return nil, ErrDropped
+		}
+		if d.edit != nil {
+			return d.edit, nil
+		}
+		return &snapshot, nil
+	case <-timer.C:
+		if ic.DropOnTimeout {
+			return nil, ErrDropped
+		}
+		return &snapshot, nil
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+func (ic *Interceptor) holdRequest(req *http.Request) (*http.Request, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read request body")
+		}
+	}
+	snapshot := Intercepted{
+		Phase:  InterceptRequest,
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Header: cloneHeader(req.Header),
+	}
+	snapshot.Body, snapshot.BodyEncoding = harText(body)
+	edited, err := ic.hold(req, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = decodeText(edited.Body, edited.BodyEncoding); err != nil {
+		return nil, errors.Wrap(err, "broken edited body")
+	}
+	u, err := url.Parse(edited.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "broken edited URL")
+	}
+	newreq := req.WithContext(req.Context())
+	newreq.Method = edited.Method
+	if u.String() != req.URL.String() {
+		newreq.URL = u
+		newreq.Host = u.Host
+	}
+	newreq.Header = cloneHeader(edited.Header)
+	newreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	newreq.ContentLength = int64(len(body))
+	newreq.Header.Del("Content-Length")
+	return newreq, nil
+}
+
+func (ic *Interceptor) holdResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response body")
+	}
+	snapshot := Intercepted{
+		Phase:  InterceptResponse,
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Status: resp.StatusCode,
+		Header: cloneHeader(resp.Header),
+	}
+	snapshot.Body, snapshot.BodyEncoding = harText(body)
+	edited, err := ic.hold(req, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = decodeText(edited.Body, edited.BodyEncoding); err != nil {
+		return nil, errors.Wrap(err, "broken edited body")
+	}
+	if edited.Status != resp.StatusCode {
+		resp.StatusCode = edited.Status
+		resp.Status = fmt.Sprintf("%d %s", edited.Status, http.StatusText(edited.Status))
+	}
+	resp.Header = cloneHeader(edited.Header)
+	resp.Header.Del("Transfer-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	return resp, nil
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vs := range h {
+		h2[k] = append([]string(nil), vs...)
+	}
+	return h2
+}
+
+// Held returns snapshots of held flows, from the oldest.
+func (ic *Interceptor) Held() []Intercepted {
+	ic.mu.Lock()
+	held := make([]Intercepted, 0, len(ic.held))
+	for _, hf := range ic.held {
+		held = append(held, hf.snapshot)
+	}
+	ic.mu.Unlock()
+	sort.Slice(held, func(i, j int) bool {
+		a, _ := strconv.ParseUint(held[i].ID, 10, 64)
+		b, _ := strconv.ParseUint(held[j].ID, 10, 64)
+		return a < b
+	})
+	return held
+}
+
+// Get returns the snapshot of the held flow identified by id.
+func (ic *Interceptor) Get(id string) (Intercepted, bool) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	hf, ok := ic.held[id]
+	if !ok {
+		return Intercepted{}, false
+	}
+	return hf.snapshot, true
+}
+
+func (ic *Interceptor) decide(id string, d interceptDecision) error {
+	ic.mu.Lock()
+	hf, ok := ic.held[id]
+	if ok {
+		// a flow is decided once.
+		delete(ic.held, id)
+	}
+	ic.mu.Unlock()
+	if !ok {
+		return errors.Errorf("held flow %s not found", id)
+	}
+	hf.decision <- d
+	return nil
+}
+
+// Resume releases the held flow identified by id.
+// If edit is non-nil, the request or the response is replaced with it.
+// For requests, Method, URL, Header and Body are used, and for responses, Status, Header and Body are used.
+func (ic *Interceptor) Resume(id string, edit *Intercepted) error {
+	if edit != nil {
+		held, ok := ic.Get(id)
+		if !ok {
+			return errors.Errorf("held flow %s not found", id)
+		}
+		if held.Phase == InterceptRequest {
+			if u, err := url.Parse(edit.URL); err != nil || !u.IsAbs() || u.Host == "" || edit.Method == "" {
+				return errors.Errorf("invalid request: %s %s", edit.Method, edit.URL)
+			}
+		} else if http.StatusText(edit.Status) == "" {
+			return errors.Errorf("invalid status code: %d", edit.Status)
+		}
+		if _, err := decodeText(edit.Body, edit.BodyEncoding); err != nil {
+			return errors.Wrap(err, "invalid body")
+		}
+	}
+	return ic.decide(id, interceptDecision{edit: edit})
+}
+
+// Drop drops the held flow identified by id.
+func (ic *Interceptor) Drop(id string) error {
+	return ic.decide(id, interceptDecision{drop: true})
+}
+
+// ResumeAll releases all held flows without changes.
+func (ic *Interceptor) ResumeAll() {
+	for _, held := range ic.Held() {
+		ic.Resume(held.ID, nil)
+	}
+}
+
+// Handler returns an http.Handler of the JSON API to operate held flows:
+//
+//	GET  /            lists held flows
+//	GET  /{id}        gets the held flow
+//	POST /{id}/resume resumes the held flow, editing it if the request has a JSON body of Intercepted
+//	POST /{id}/drop   drops the held flow
+//
+// Use http.StripPrefix to serve it under a path.
+func (ic *Interceptor) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "" && r.Method == "GET":
+			writeJSON(w, http.StatusOK, ic.Held())
+		case len(parts) == 1 && r.Method == "GET":
+			held, ok := ic.Get(parts[0])
+			if !ok {
+				writeJSONError(w, http.StatusNotFound, "held flow not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, held)
+		case len(parts) == 2 && parts[1] == "resume" && r.Method == "POST":
+			var edit *Intercepted
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if len(bytes.TrimSpace(body)) > 0 {
+				current, ok := ic.Get(parts[0])
+				if !ok {
+					writeJSONError(w, http.StatusNotFound, "held flow not found")
+					return
+				}
+				// fields missing in the body are kept.
+				edit = &current
+				if err := json.Unmarshal(body, edit); err != nil {
+					writeJSONError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+					return
+				}
+			}
+			if err := ic.Resume(parts[0], edit); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 2 && parts[1] == "drop" && r.Method == "POST":
+			if err := ic.Drop(parts[0]); err != nil {
+				writeJSONError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSONError(w, http.StatusNotFound, "not found")
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{msg})
+}
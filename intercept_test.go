@@ -0,0 +1,157 @@
+package groxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInterceptor(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("X-Edited")))
+	}))
+	defer ts.Close()
+
+	held := make(chan Intercepted, 1)
+	ic := &Interceptor{
+		Request:  PathPrefix("/req"),
+		Response: PathPrefix("/resp"),
+		OnHold:   func(i Intercepted) { held <- i },
+	}
+	proxy := ProxyServer{}
+	proxy.Use(ic.Middleware())
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, _ := url.Parse(proxyserver.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	api := httptest.NewServer(http.StripPrefix("/intercept", ic.Handler()))
+	defer api.Close()
+
+	type result struct {
+		code int
+		body string
+	}
+	get := func(path string) <-chan result {
+		c := make(chan result, 1)
+		go func() {
+			resp, err := client.Get(ts.URL + path)
+			if err != nil {
+				c <- result{body: err.Error()}
+				return
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			c <- result{resp.StatusCode, string(body)}
+		}()
+		return c
+	}
+	post := func(path, body string) int {
+		resp, err := http.Post(api.URL+"/intercept/"+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to request the API: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	cases := []struct {
+		path     string
+		action   string
+		edit     string
+		expected result
+	}{
+		{"/req", "resume", `{"url": "` + ts.URL + `/edited", "header": {"X-Edited": ["yes"]}}`, result{200, "/edited yes"}},
+		{"/req", "resume", "", result{200, "/req "}},
+		{"/resp", "resume", `{"status": 201, "body": "edited"}`, result{201, "edited"}},
+		{"/req", "drop", "", result{502, "request failed: dropped by interceptor\n"}},
+	}
+	for _, c := range cases {
+		resc := get(c.path)
+		var h Intercepted
+		select {
+		case h = <-held:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: expected the flow is held", c.path)
+		}
+		if list := ic.Held(); len(list) != 1 || list[0].ID != h.ID {
+			t.Errorf("%s: expected the held flow is listed, but got %v", c.path, list)
+		}
+		if code := post(h.ID+"/"+c.action, c.edit); code != http.StatusNoContent {
+			t.Errorf("%s: expected status code of %s is %d, but got %d", c.path, c.action, http.StatusNoContent, code)
+		}
+		if res := <-resc; res != c.expected {
+			t.Errorf("%s: expected result is %v, but got %v", c.path, c.expected, res)
+		}
+	}
+	if code := post("100/resume", ""); code != http.StatusBadRequest {
+		t.Errorf("expected resuming unknown flows gets %d, but got %d", http.StatusBadRequest, code)
+	}
+	if len(ic.Held()) != 0 {
+		t.Errorf("expected no flows are held, but got %v", ic.Held())
+	}
+}
+
+func TestInterceptorTimeout(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		ic := &Interceptor{Request: Method("GET"), Timeout: 50 * time.Millisecond, DropOnTimeout: drop}
+		h := ic.Middleware()(func(req *http.Request) (*http.Response, error) {
+			return NewResponse(req, http.StatusOK, "text/plain", []byte("ok")), nil
+		})
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		resp, err := h(req)
+		if drop {
+			if err != ErrDropped {
+				t.Errorf("expected the flow is dropped on timeout, but got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected the flow is resumed on timeout, but got %v", err)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestInterceptorMITMClientDisconnect(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	held := make(chan Intercepted, 1)
+	ic := &Interceptor{Request: Method("POST"), OnHold: func(i Intercepted) { held <- i }}
+	log := &recordLogger{}
+	proxy := ProxyServer{HTTPSAction: HTTPSActionMITM, Logger: log}
+	proxy.Use(ic.Middleware())
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	conn, _ := connect(t, proxyserver, ts.Listener.Addr().String())
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	fmt.Fprintf(tlsConn, "POST / HTTP/1.1\r\nHost: %s\r\nContent-Length: 4\r\n\r\nbody", ts.Listener.Addr())
+	var h Intercepted
+	select {
+	case h = <-held:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the flow is held")
+	}
+	if err := ic.Resume(h.ID, &Intercepted{Method: "GET", URL: "/relative"}); err == nil {
+		t.Errorf("expected resuming with a URL without host is an error")
+	}
+
+	tlsConn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(ic.Held()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(ic.Held()) > 0 {
+		t.Errorf("expected the held flow is cancelled when the client disconnects")
+	}
+	if !log.contains("client disconnected") {
+		t.Errorf("expected the disconnection is logged")
+	}
+}
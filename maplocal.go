@@ -0,0 +1,116 @@
+package groxy
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LocalMapping maps URLs to a local file or directory.
+type LocalMapping struct {
+	// URL is a prefix of URLs to map, e.g. "https://example.com/static/".
+	// If the scheme is omitted (e.g. "example.com/static/"), both of HTTP and HTTPS requests are mapped.
+	URL string `json:"url"`
+	// Path is a local file or directory. If it's a directory,
+	// the rest of the URL path after the prefix is resolved in it, and "index.html" is served for directories.
+	Path string `json:"path"`
+	// Fallthrough sends requests to target servers if the files are not found.
+	// If it's false, http.StatusNotFound is returned.
+	Fallthrough bool `json:"fallthrough,omitempty"`
+}
+
+func (m *LocalMapping) match(req *http.Request) (rest string, ok bool) {
+	target := req.URL.Host + req.URL.Path
+	if strings.Contains(m.URL, "://") {
+		target = req.URL.Scheme + "://" + target
+	}
+	if !strings.HasPrefix(target, m.URL) {
+		return "", false
+	}
+	return target[len(m.URL):], true
+}
+
+// file returns the local file for the rest of the URL path.
+func (m *LocalMapping) file(rest string) (string, os.FileInfo, error) {
+	name := m.Path
+	fi, err := os.Stat(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if fi.IsDir() {
+		// path.Clean with the leading slash removes ".." elements, so the file is always under m.Path.
+		name = filepath.Join(m.Path, filepath.FromSlash(path.Clean("/"+rest)))
+		if fi, err = os.Stat(name); err != nil {
+			return "", nil, err
+		}
+		if fi.IsDir() {
+			name = filepath.Join(name, "index.html")
+			if fi, err = os.Stat(name); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	return name, fi, nil
+}
+
+// MapLocal returns a Middleware that serves local files for GET and HEAD requests matching mappings,
+// instead of requesting target servers. The first matching mapping is used.
+// Content-Type is guessed by the file extension, or the content if the extension is unknown.
+func MapLocal(mappings ...LocalMapping) Middleware {
+	return func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			if req.Method != "GET" && req.Method != "HEAD" {
+				return h(req)
+			}
+			for _, m := range mappings {
+				rest, ok := m.match(req)
+				if !ok {
+					continue
+				}
+				name, fi, err := m.file(rest)
+				if err != nil {
+					if m.Fallthrough {
+						return h(req)
+					}
+					return NewResponse(req, http.StatusNotFound, "text/plain; charset=utf-8", []byte("file not found\n")), nil
+				}
+				return serveLocalFile(req, name, fi)
+			}
+			return h(req)
+		}
+	}
+}
+
+func serveLocalFile(req *http.Request, name string, fi os.FileInfo) (*http.Response, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		buf := make([]byte, 512)
+		n, _ := io.ReadFull(f, buf)
+		contentType = http.DetectContentType(buf[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	resp := NewResponse(req, http.StatusOK, contentType, nil)
+	resp.Header.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	resp.Header.Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	resp.ContentLength = fi.Size()
+	if req.Method == "HEAD" {
+		f.Close()
+		resp.Body = ioutil.NopCloser(strings.NewReader(""))
+	} else {
+		resp.Body = f
+	}
+	return resp, nil
+}
@@ -0,0 +1,86 @@
+package groxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMapLocal(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("remote"))
+	}))
+	defer ts.Close()
+	tsurl, _ := url.Parse(ts.URL)
+
+	dir, err := ioutil.TempDir("", "groxy-maplocal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "static", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "static", "app.js"), []byte("console.log(1)"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "static", "sub", "index.html"), []byte("<p>index</p>"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "config"), []byte(`{"local": true}`), 0644)
+
+	proxy := ProxyServer{HTTPSAction: HTTPSActionMITM}
+	proxy.Use(MapLocal(
+		LocalMapping{URL: "https://" + tsurl.Host + "/static/", Path: filepath.Join(dir, "static")},
+		LocalMapping{URL: tsurl.Host + "/config", Path: filepath.Join(dir, "config")},
+		LocalMapping{URL: tsurl.Host + "/fallthrough/", Path: filepath.Join(dir, "static"), Fallthrough: true},
+	))
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyurl),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	cases := []struct {
+		path        string
+		code        int
+		body        string
+		contentType string
+	}{
+		{"/static/app.js", http.StatusOK, "console.log(1)", "javascript"},
+		{"/static/sub/", http.StatusOK, "<p>index</p>", "text/html"},
+		{"/static/../secret", http.StatusNotFound, "", ""},
+		{"/static/missing.css", http.StatusNotFound, "", ""},
+		{"/config", http.StatusOK, `{"local": true}`, "text/plain"},
+		{"/fallthrough/missing", http.StatusOK, "remote", ""},
+		{"/other", http.StatusOK, "remote", ""},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", ts.URL+c.path, nil)
+		req.URL.Opaque = c.path // keep ".." elements
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("%s: expected status code is %v, but got %v", c.path, c.code, resp.StatusCode)
+			continue
+		}
+		if c.body != "" && string(body) != c.body {
+			t.Errorf("%s: expected response body is %q, but got %q", c.path, c.body, string(body))
+		}
+		if ct := resp.Header.Get("Content-Type"); c.contentType != "" && !strings.Contains(ct, c.contentType) {
+			t.Errorf("%s: expected Content-Type contains %q, but got %q", c.path, c.contentType, ct)
+		}
+	}
+}
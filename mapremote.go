@@ -0,0 +1,102 @@
+package groxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RemoteMapping rewrites destinations of requests.
+type RemoteMapping struct {
+	// From is a prefix of URLs to rewrite, e.g. "https://api.example.com/v1/".
+	// If the scheme is omitted (e.g. "api.example.com/v1/"), both of HTTP and HTTPS requests are rewritten.
+	From string `json:"from"`
+	// To is a prefix of URLs to rewrite to, e.g. "http://localhost:8080/".
+	// The rest of the URL path after From is joined to it with a slash, and the query string is kept.
+	To string `json:"to"`
+	// PreserveHost keeps the Host header of the original request.
+	PreserveHost bool `json:"preserveHost,omitempty"`
+}
+
+type remoteMapping struct {
+	from         string
+	to           *url.URL
+	preserveHost bool
+}
+
+func (m *remoteMapping) match(req *http.Request) (rest string, ok bool) {
+	target := req.URL.Host + req.URL.Path
+	if strings.Contains(m.from, "://") {
+		target = req.URL.Scheme + "://" + target
+	}
+	if !strings.HasPrefix(target, m.from) {
+		return "", false
+	}
+	return target[len(m.from):], true
+}
+
+// joinPath joins a path prefix and the rest of a path with a single slash.
+func joinPath(prefix, rest string) string {
+	if rest == "" {
+		if prefix == "" {
+			return "/"
+		}
+		return prefix
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(rest, "/")
+}
+
+// MapRemote returns a Middleware that rewrites scheme, host, port and path prefix of requests matching mappings.
+// The first matching mapping is used. It works for both proxy requests and MITM requests.
+//
+// A request is rewritten at most once, even if MapRemote middlewares are used more than once,
+// so a destination matching mappings again is not rewritten twice.
+func MapRemote(mappings ...RemoteMapping) (Middleware, error) {
+	ms := make([]remoteMapping, 0, len(mappings))
+	for _, m := range mappings {
+		to, err := url.Parse(m.To)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid destination %q", m.To)
+		}
+		if to.Host == "" {
+			return nil, errors.Errorf("destination %q has no host", m.To)
+		}
+		ms = append(ms, remoteMapping{from: m.From, to: to, preserveHost: m.PreserveHost})
+	}
+	return func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			if req.Context().Value(mapRemoteContextKey) != nil {
+				return h(req)
+			}
+			for _, m := range ms {
+				rest, ok := m.match(req)
+				if !ok {
+					continue
+				}
+				host := req.Host
+				if host == "" {
+					host = req.URL.Host
+				}
+				u := *req.URL
+				if m.to.Scheme != "" {
+					u.Scheme = m.to.Scheme
+				}
+				u.Host = m.to.Host
+				u.Path = joinPath(m.to.Path, rest)
+				u.RawPath = ""
+				req = req.WithContext(context.WithValue(req.Context(), mapRemoteContextKey, true))
+				req.URL = &u
+				if m.preserveHost {
+					req.Host = host
+				} else {
+					req.Host = u.Host
+				}
+				break
+			}
+			return h(req)
+		}
+	}, nil
+}
@@ -0,0 +1,113 @@
+package groxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestMapRemote(t *testing.T) {
+	prod := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("prod"))
+	}))
+	defer prod.Close()
+	produrl, _ := url.Parse(prod.URL)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("local " + r.Host + " " + r.URL.RequestURI()))
+	}))
+	defer local.Close()
+	localurl, _ := url.Parse(local.URL)
+
+	mapper, err := MapRemote(
+		RemoteMapping{From: "https://" + produrl.Host + "/api/v1/", To: local.URL + "/v1/"},
+		RemoteMapping{From: produrl.Host + "/keep/", To: local.URL + "/", PreserveHost: true},
+		RemoteMapping{From: produrl.Host + "/noslash/", To: local.URL + "/base"},
+	)
+	if err != nil {
+		t.Fatalf("failed to create MapRemote: %v", err)
+	}
+	proxy := ProxyServer{HTTPSAction: HTTPSActionMITM}
+	proxy.Use(mapper)
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyurl),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	cases := []struct {
+		path, expected string
+	}{
+		{"/api/v1/users?id=1", "local " + localurl.Host + " /v1/users?id=1"},
+		{"/keep/page", "local " + produrl.Host + " /page"},
+		{"/api/v2/users", "prod"},
+		{"/noslash/v1/x", "local " + localurl.Host + " /base/v1/x"},
+	}
+	for _, c := range cases {
+		resp, err := client.Get(prod.URL + c.path)
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != c.expected {
+			t.Errorf("%s: expected response body is %q, but got %q", c.path, c.expected, string(body))
+		}
+	}
+
+	if _, err := MapRemote(RemoteMapping{From: "example.com/", To: "/no-host"}); err == nil {
+		t.Errorf("expected destinations without hosts are rejected, but no error occurred")
+	}
+}
+
+func TestMapRemoteOnce(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + r.Header.Get("X-Groxy-Map-Remote")))
+	}))
+	defer local.Close()
+	localurl, _ := url.Parse(local.URL)
+
+	// the destination of the mapping matches the mapping again.
+	mapper, err := MapRemote(RemoteMapping{From: localurl.Host + "/api/", To: local.URL + "/api/v2/"})
+	if err != nil {
+		t.Fatalf("failed to create MapRemote: %v", err)
+	}
+	proxy := &ProxyServer{}
+	proxy.Use(mapper, mapper)
+	proxyserver := httptest.NewServer(proxy)
+	defer proxyserver.Close()
+	proxyurl, _ := url.Parse(proxyserver.URL)
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+	resp, err := client.Get(local.URL + "/api/users")
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/api/v2/users" {
+		t.Errorf("expected the request is rewritten once to %q, but got %q", "/api/v2/users", string(body))
+	}
+
+	// clients can not skip mappings with headers.
+	req, _ := http.NewRequest("GET", local.URL+"/api/users", nil)
+	req.Header.Set("X-Groxy-Map-Remote", "1")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/api/v2/users1" {
+		t.Errorf("expected the request is rewritten regardless of headers, but got %q", string(body))
+	}
+}
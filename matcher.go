@@ -0,0 +1,142 @@
+package groxy
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Matcher reports whether a request matches some condition.
+type Matcher func(*http.Request) bool
+
+// When returns a Middleware that applies m only to requests matching cond.
+// Other requests are passed to the original Handler as they are.
+//
+//	p.Use(groxy.When(groxy.Host("*.example.com"), m))
+func When(cond Matcher, m Middleware) Middleware {
+	return func(h Handler) Handler {
+		wrapped := m(h)
+		return func(req *http.Request) (*http.Response, error) {
+			if cond(req) {
+				return wrapped(req)
+			}
+			return h(req)
+		}
+	}
+}
+
+// All returns a Matcher that matches requests matching all of ms.
+func All(ms ...Matcher) Matcher {
+	return func(req *http.Request) bool {
+		for _, m := range ms {
+			if !m(req) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Any returns a Matcher that matches requests matching any of ms.
+func Any(ms ...Matcher) Matcher {
+	return func(req *http.Request) bool {
+		for _, m := range ms {
+			if m(req) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not returns a Matcher that matches requests not matching m.
+func Not(m Matcher) Matcher {
+	return func(req *http.Request) bool {
+		return !m(req)
+	}
+}
+
+// requestHost returns the destination host of req without port.
+func requestHost(req *http.Request) string {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return normalizeHost(host)
+}
+
+// Host returns a Matcher that matches destination hosts by the glob pattern (see path.Match).
+// Ports are ignored and the match is case-insensitive.
+func Host(pattern string) Matcher {
+	pattern = normalizeHost(pattern)
+	return func(req *http.Request) bool {
+		ok, _ := path.Match(pattern, requestHost(req))
+		return ok
+	}
+}
+
+// PathPrefix returns a Matcher that matches URL paths starting with prefix.
+func PathPrefix(prefix string) Matcher {
+	return func(req *http.Request) bool {
+		return strings.HasPrefix(req.URL.Path, prefix)
+	}
+}
+
+// PathRegexp returns a Matcher that matches URL paths by re.
+func PathRegexp(re *regexp.Regexp) Matcher {
+	return func(req *http.Request) bool {
+		return re.MatchString(req.URL.Path)
+	}
+}
+
+// Method returns a Matcher that matches any of methods.
+func Method(methods ...string) Matcher {
+	return func(req *http.Request) bool {
+		for _, m := range methods {
+			if strings.EqualFold(req.Method, m) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Header returns a Matcher that matches requests having the header key with a value matching the glob pattern.
+// If pattern is empty, it matches requests having the header regardless of its value.
+func Header(key, pattern string) Matcher {
+	return func(req *http.Request) bool {
+		vs, ok := req.Header[http.CanonicalHeaderKey(key)]
+		if !ok {
+			return false
+		}
+		if pattern == "" {
+			return true
+		}
+		for _, v := range vs {
+			if ok, _ := path.Match(pattern, v); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Scheme returns a Matcher that matches URL schemes, e.g. "http" or "https" (MITM requests).
+func Scheme(scheme string) Matcher {
+	return func(req *http.Request) bool {
+		return strings.EqualFold(req.URL.Scheme, scheme)
+	}
+}
+
+// ClientIP returns a Matcher that matches requests from clients in nets.
+func ClientIP(nets ...*net.IPNet) Matcher {
+	return func(req *http.Request) bool {
+		ip := remoteIP(req)
+		return ip != nil && containsIP(nets, ip)
+	}
+}
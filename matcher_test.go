@@ -0,0 +1,81 @@
+package groxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestMatchers(t *testing.T) {
+	nets, _ := ParseCIDRs([]string{"10.0.0.0/8"})
+	req, _ := http.NewRequest("POST", "https://api.example.com:8443/v1/users?q=1", nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "10.1.2.3:5000"
+
+	cases := []struct {
+		name     string
+		m        Matcher
+		expected bool
+	}{
+		{"host glob", Host("*.example.com"), true},
+		{"host exact", Host("API.example.com"), true},
+		{"host mismatch", Host("example.com"), false},
+		{"path prefix", PathPrefix("/v1/"), true},
+		{"path prefix mismatch", PathPrefix("/v2/"), false},
+		{"path regexp", PathRegexp(regexp.MustCompile(`^/v\d+/users$`)), true},
+		{"method", Method("GET", "post"), true},
+		{"method mismatch", Method("GET"), false},
+		{"header", Header("content-type", "application/*"), true},
+		{"header presence", Header("Content-Type", ""), true},
+		{"header missing", Header("Authorization", ""), false},
+		{"scheme", Scheme("https"), true},
+		{"client ip", ClientIP(nets...), true},
+		{"all", All(Host("*.example.com"), Method("POST")), true},
+		{"all mismatch", All(Host("*.example.com"), Method("GET")), false},
+		{"any", Any(Method("GET"), Scheme("https")), true},
+		{"not", Not(Scheme("https")), false},
+	}
+	for _, c := range cases {
+		if got := c.m(req); got != c.expected {
+			t.Errorf("%s: expected %v, but got %v", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestWhen(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("original"))
+	}))
+	defer ts.Close()
+
+	var proxy ProxyServer
+	proxy.Use(When(Header("X-Mock", "yes"), func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			return NewResponse(req, http.StatusOK, "text/plain", []byte("mocked")), nil
+		}
+	}))
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+
+	for header, expected := range map[string]string{"yes": "mocked", "no": "original"} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Header.Set("X-Mock", header)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expected {
+			t.Errorf("expected response body is %q, but got %q", expected, string(body))
+		}
+	}
+}
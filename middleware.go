@@ -1,6 +1,12 @@
 package groxy
 
-import "net/http"
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
 
 // Handler handles http.Request and somehow generate http.Response or error.
 type Handler func(*http.Request) (*http.Response, error)
@@ -15,6 +21,7 @@ var httpclient = &http.Client{
 }
 
 // DefaultHTTPHandler pass the request to the target server, and returns its response or error.
+// ProxyServer does not use it, but uses ProxyServer.Transport instead.
 func DefaultHTTPHandler(req *http.Request) (*http.Response, error) {
 	return httpclient.Do(req)
 }
@@ -23,3 +30,23 @@ func DefaultHTTPHandler(req *http.Request) (*http.Response, error) {
 func DefaultHTTPSHandler(tr *http.Transport) Handler {
 	return tr.RoundTrip
 }
+
+// NewResponse creates a response for req with a body, to return it from Handler without requesting the target server.
+func NewResponse(req *http.Request, code int, contentType string, body []byte) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp
+}
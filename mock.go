@@ -0,0 +1,280 @@
+package groxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MockRule is a stub response served for matching requests, instead of requesting target servers.
+type MockRule struct {
+	Match MockMatch `json:"match"`
+	// Status is the status code of the response. If it's zero, http.StatusOK is used.
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	// BodyFile is a file whose content is used as the body instead of Body.
+	// A relative path is resolved from the directory of the mock file.
+	BodyFile string `json:"bodyFile,omitempty"`
+	// Delay delays the response, e.g. "500ms" (see time.ParseDuration).
+	Delay string `json:"delay,omitempty"`
+}
+
+// MockMatch is a condition of requests for a MockRule. Empty fields match any request.
+type MockMatch struct {
+	// Host is a glob pattern of destination hosts (see Host).
+	Host       string   `json:"host,omitempty"`
+	Methods    []string `json:"methods,omitempty"`
+	Scheme     string   `json:"scheme,omitempty"`
+	PathPrefix string   `json:"pathPrefix,omitempty"`
+	PathRegexp string   `json:"pathRegexp,omitempty"`
+	// Headers maps header names to glob patterns of their values (see Header).
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func (mm *MockMatch) matcher() (Matcher, error) {
+	var ms []Matcher
+	if mm.Host != "" {
+		ms = append(ms, Host(mm.Host))
+	}
+	if len(mm.Methods) > 0 {
+		ms = append(ms, Method(mm.Methods...))
+	}
+	if mm.Scheme != "" {
+		ms = append(ms, Scheme(mm.Scheme))
+	}
+	if mm.PathPrefix != "" {
+		ms = append(ms, PathPrefix(mm.PathPrefix))
+	}
+	if mm.PathRegexp != "" {
+		re, err := regexp.Compile(mm.PathRegexp)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid path regexp")
+		}
+		ms = append(ms, PathRegexp(re))
+	}
+	for k, v := range mm.Headers {
+		ms = append(ms, Header(k, v))
+	}
+	return All(ms...), nil
+}
+
+type mock struct {
+	match   Matcher
+	status  int
+	headers http.Header
+	body    []byte
+	delay   time.Duration
+}
+
+// Mocks serves stub responses defined by MockRules. The first matching rule is used.
+//
+// Rules are usually loaded from a JSON file of an array of MockRule by LoadMocks:
+//
+//	[
+//	  {
+//	    "match": {"host": "api.example.com", "methods": ["GET"], "pathPrefix": "/v1/users"},
+//	    "status": 200,
+//	    "headers": {"Content-Type": "application/json"},
+//	    "bodyFile": "users.json",
+//	    "delay": "200ms"
+//	  }
+//	]
+//
+// Mocks is safe for concurrent use, and the rules can be replaced while serving by Reload or Watch.
+type Mocks struct {
+	// Filename is the mock file. It's set by LoadMocks.
+	Filename string
+	// Logger logs reloads of the mock file.
+	Logger Logger
+
+	mu       sync.RWMutex
+	mocks    []mock
+	modTimes map[string]time.Time // the mock file and body files
+}
+
+// NewMocks creates Mocks serving rules. Relative paths of BodyFile are resolved from the current directory.
+func NewMocks(rules ...MockRule) (*Mocks, error) {
+	m := &Mocks{}
+	mocks, modTimes, err := compileMocks(rules, ".")
+	if err != nil {
+		return nil, err
+	}
+	m.mocks, m.modTimes = mocks, modTimes
+	return m, nil
+}
+
+// LoadMocks creates Mocks serving rules in the JSON file.
+func LoadMocks(filename string) (*Mocks, error) {
+	m := &Mocks{Filename: filename}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Mocks) log(args ...interface{}) {
+	if m.Logger != nil {
+		m.Logger.Print(args...)
+	}
+}
+
+// Reload reads the mock file again. If it fails, the current rules are kept.
+func (m *Mocks) Reload() error {
+	if m.Filename == "" {
+		return errors.New("no mock file")
+	}
+	fi, err := os.Stat(m.Filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to open mock file")
+	}
+	data, err := ioutil.ReadFile(m.Filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to read mock file")
+	}
+	var rules []MockRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return errors.Wrapf(err, "failed to parse mock file %s", m.Filename)
+	}
+	mocks, modTimes, err := compileMocks(rules, filepath.Dir(m.Filename))
+	if err != nil {
+		return errors.Wrapf(err, "mock file %s", m.Filename)
+	}
+	modTimes[m.Filename] = fi.ModTime()
+	m.mu.Lock()
+	m.mocks, m.modTimes = mocks, modTimes
+	m.mu.Unlock()
+	return nil
+}
+
+func compileMocks(rules []MockRule, dir string) ([]mock, map[string]time.Time, error) {
+	mocks := make([]mock, 0, len(rules))
+	modTimes := make(map[string]time.Time)
+	for i, rule := range rules {
+		match, err := rule.Match.matcher()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "mock %d", i)
+		}
+		mk := mock{match: match, status: rule.Status, headers: make(http.Header), body: []byte(rule.Body)}
+		if mk.status == 0 {
+			mk.status = http.StatusOK
+		}
+		for k, v := range rule.Headers {
+			mk.headers.Set(k, v)
+		}
+		if rule.BodyFile != "" {
+			name := rule.BodyFile
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(dir, name)
+			}
+			fi, err := os.Stat(name)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "mock %d: failed to open body file", i)
+			}
+			if mk.body, err = ioutil.ReadFile(name); err != nil {
+				return nil, nil, errors.Wrapf(err, "mock %d: failed to read body file", i)
+			}
+			modTimes[name] = fi.ModTime()
+		}
+		if rule.Delay != "" {
+			if mk.delay, err = time.ParseDuration(rule.Delay); err != nil {
+				return nil, nil, errors.Wrapf(err, "mock %d: invalid delay", i)
+			}
+		}
+		mocks = append(mocks, mk)
+	}
+	return mocks, modTimes, nil
+}
+
+// changed reports whether the mock file or body files have been modified since they were loaded.
+func (m *Mocks) changed() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for name, t := range m.modTimes {
+		fi, err := os.Stat(name)
+		if err != nil || !fi.ModTime().Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the mock file whenever it or body files are modified, checking them every interval.
+// Failures of reloading are logged and the current rules are kept. Call stop to stop watching.
+func (m *Mocks) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var lastErr string
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if !m.changed() {
+				continue
+			}
+			if err := m.Reload(); err != nil {
+				// the files keep being changed until they are fixed, so log the same error once.
+				if err.Error() != lastErr {
+					m.log("failed to reload mocks: ", err)
+					lastErr = err.Error()
+				}
+				continue
+			}
+			lastErr = ""
+			m.log("reloaded mocks from ", m.Filename)
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (m *Mocks) find(req *http.Request) *mock {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.mocks {
+		if m.mocks[i].match(req) {
+			return &m.mocks[i]
+		}
+	}
+	return nil
+}
+
+// Middleware returns a Middleware that serves stub responses for matching requests.
+// Other requests are passed to the original Handler.
+func (m *Mocks) Middleware() Middleware {
+	return func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			mk := m.find(req)
+			if mk == nil {
+				return h(req)
+			}
+			if mk.delay > 0 {
+				t := time.NewTimer(mk.delay)
+				select {
+				case <-t.C:
+				case <-req.Context().Done():
+					t.Stop()
+					return nil, req.Context().Err()
+				}
+			}
+			resp := NewResponse(req, mk.status, "", mk.body)
+			for k, vs := range mk.headers {
+				resp.Header[k] = append([]string(nil), vs...)
+			}
+			resp.Header.Set("Content-Length", strconv.Itoa(len(mk.body)))
+			return resp, nil
+		}
+	}
+}
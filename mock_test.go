@@ -0,0 +1,137 @@
+package groxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMocks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("remote"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "groxy-mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "users.json"), []byte(`[{"id": 1}]`), 0644)
+	filename := filepath.Join(dir, "mocks.json")
+	ioutil.WriteFile(filename, []byte(`[
+		{"match": {"methods": ["GET"], "pathPrefix": "/users"}, "headers": {"Content-Type": "application/json"}, "bodyFile": "users.json"},
+		{"match": {"pathRegexp": "^/items/[0-9]+$", "headers": {"X-Mock": "yes"}}, "status": 201, "body": "item", "delay": "50ms"}
+	]`), 0644)
+
+	mocks, err := LoadMocks(filename)
+	if err != nil {
+		t.Fatalf("failed to load mocks: %v", err)
+	}
+	proxy := ProxyServer{}
+	proxy.Use(mocks.Middleware())
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, _ := url.Parse(proxyserver.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyurl)}}
+
+	cases := []struct {
+		method, path string
+		header       http.Header
+		status       int
+		contentType  string
+		body         string
+		delayed      bool
+	}{
+		{"GET", "/users/1", nil, 200, "application/json", `[{"id": 1}]`, false},
+		{"POST", "/users/1", nil, 200, "text/plain; charset=utf-8", "remote", false},
+		{"GET", "/items/1", http.Header{"X-Mock": {"yes"}}, 201, "text/plain; charset=utf-8", "item", true},
+		{"GET", "/items/1", nil, 200, "text/plain; charset=utf-8", "remote", false},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, ts.URL+c.path, nil)
+		for k, vs := range c.header {
+			req.Header[k] = vs
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %s: expected status code is %d, but got %d", c.method, c.path, c.status, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != c.contentType {
+			t.Errorf("%s %s: expected Content-Type is %q, but got %q", c.method, c.path, c.contentType, ct)
+		}
+		if string(body) != c.body {
+			t.Errorf("%s %s: expected response body is %q, but got %q", c.method, c.path, c.body, string(body))
+		}
+		if c.delayed && time.Since(start) < 50*time.Millisecond {
+			t.Errorf("%s %s: expected the response is delayed, but got it in %v", c.method, c.path, time.Since(start))
+		}
+	}
+}
+
+func TestMocksWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "groxy-mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "mocks.json")
+	write := func(content string, mtime time.Time) {
+		ioutil.WriteFile(filename, []byte(content), 0644)
+		os.Chtimes(filename, mtime, mtime)
+	}
+	write(`[{"match": {"pathPrefix": "/"}, "body": "v1"}]`, time.Now().Add(-time.Hour))
+
+	log := &recordLogger{}
+	mocks, err := LoadMocks(filename)
+	if err != nil {
+		t.Fatalf("failed to load mocks: %v", err)
+	}
+	mocks.Logger = log
+	h := mocks.Middleware()(DefaultHTTPHandler)
+	get := func() string {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		resp, err := h(req)
+		if err != nil {
+			t.Fatalf("failed to serve mock: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	stop := mocks.Watch(10 * time.Millisecond)
+	defer stop()
+
+	write(`[{"match": {"pathPrefix": "/"}, "body": "v2"}]`, time.Now().Add(-time.Minute))
+	deadline := time.Now().Add(2 * time.Second)
+	for get() != "v2" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if body := get(); body != "v2" {
+		t.Errorf("expected the mock is reloaded to %q, but got %q", "v2", body)
+	}
+
+	// broken files keep the current rules.
+	write(`[{"match": {"pathRegexp": "("}, "body": "v3"}]`, time.Now())
+	deadline = time.Now().Add(2 * time.Second)
+	for !log.contains("failed to reload mocks") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !log.contains("failed to reload mocks") {
+		t.Errorf("expected the reload failure is logged")
+	}
+	if body := get(); body != "v2" {
+		t.Errorf("expected the current mock %q is kept, but got %q", "v2", body)
+	}
+}
@@ -0,0 +1,71 @@
+package groxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PortPolicy restricts destination ports of CONNECT requests.
+type PortPolicy struct {
+	// Ports lists ports allowed for any host. If it's empty, only 443 is allowed.
+	Ports []int `json:"ports,omitempty"`
+	// Hosts overrides allowed ports for specific hosts. Host names are case-insensitive.
+	Hosts map[string][]int `json:"hosts,omitempty"`
+}
+
+func (pp *PortPolicy) hostPorts(host string) ([]int, bool) {
+	host = normalizeHost(host)
+	for h, ports := range pp.Hosts {
+		if normalizeHost(h) == host {
+			return ports, true
+		}
+	}
+	return nil, false
+}
+
+// Permits reports whether a tunnel to host:port is allowed.
+func (pp *PortPolicy) Permits(host string, port int) bool {
+	ports, ok := pp.hostPorts(host)
+	if !ok {
+		ports = pp.Ports
+		if len(ports) == 0 {
+			ports = []int{443}
+		}
+	}
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// permitsAddr reports whether a tunnel to addr ("host:port") is allowed.
+func (pp *PortPolicy) permitsAddr(addr string) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	return err == nil && pp.Permits(host, port)
+}
+
+// withDefaultPort returns host with port if host has no port.
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
+
+func (p *ProxyServer) permitsPort(w http.ResponseWriter, r *http.Request) bool {
+	ports := p.current().connectPorts
+	if ports == nil || ports.permitsAddr(r.URL.Host) {
+		return true
+	}
+	p.log("rejected CONNECT to ", r.URL.Host, " from ", r.RemoteAddr, ": port is not allowed")
+	http.Error(w, "CONNECT to the port is not allowed", http.StatusForbidden)
+	return false
+}
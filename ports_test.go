@@ -0,0 +1,78 @@
+package groxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestPortPolicyPermits(t *testing.T) {
+	policy := &PortPolicy{Hosts: map[string][]int{"Git.Example.com": {22, 443}}}
+	cases := []struct {
+		host     string
+		port     int
+		expected bool
+	}{
+		{"example.com", 443, true},
+		{"example.com", 22, false},
+		{"git.example.com", 22, true},
+		{"GIT.example.com", 443, true},
+		{"git.example.com", 25, false},
+	}
+	for _, c := range cases {
+		if got := policy.Permits(c.host, c.port); got != c.expected {
+			t.Errorf("expected Permits(%s, %d) is %v, but got %v", c.host, c.port, c.expected, got)
+		}
+	}
+}
+
+func TestRejectConnectPort(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	logger := &recordLogger{}
+	proxy := ProxyServer{Logger: logger, ConnectPorts: &PortPolicy{}}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	conn, resp := connect(t, proxyserver, ts.Listener.Addr().String())
+	conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status code is %v, but got %v", http.StatusForbidden, resp.StatusCode)
+	}
+	if !logger.contains("port is not allowed") {
+		t.Errorf("expected the rejection is logged, but got %v", logger.logs)
+	}
+}
+
+func TestRejectConnectPortInMITM(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	allowed, _ := strconv.Atoi(port)
+
+	proxy := ProxyServer{HTTPSAction: HTTPSActionMITM, ConnectPorts: &PortPolicy{Ports: []int{allowed}}}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+
+	cases := []struct {
+		host     string
+		expected int
+	}{
+		{ts.Listener.Addr().String(), http.StatusOK},
+		// the request names another port than the CONNECT request.
+		{"127.0.0.1:25", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		conn, resp := connect(t, proxyserver, ts.Listener.Addr().String())
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code of CONNECT is %v, but got %v", http.StatusOK, resp.StatusCode)
+		}
+		if resp := mitmGet(t, conn, c.host); resp.StatusCode != c.expected {
+			t.Errorf("%s: expected status code is %v, but got %v", c.host, c.expected, resp.StatusCode)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,335 @@
+package groxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+const (
+	defaultMaxBodySize       = 1 << 20
+	defaultMaxEntriesPerFile = 1000
+	defaultHistorySize       = 1000
+)
+
+// Recorder records requests and responses passing through its Middleware, and writes them as HAR files.
+// Use it as the outermost middleware to record what clients actually send and receive.
+//
+// Entries are written to a new file in Dir whenever MaxEntriesPerFile entries are recorded, or Flush is called.
+// The most recent entries are also kept in memory (see Entries).
+type Recorder struct {
+	// Dir is a directory where HAR files are written. If it's empty, entries are only kept in memory.
+	Dir string
+	// MaxBodySize limits bytes of each body to record. If it's zero, 1 MiB is used.
+	// If it's negative, bodies are not recorded.
+	MaxBodySize int64
+	// MaxEntriesPerFile is the number of entries to rotate HAR files. If it's zero, 1000 is used.
+	MaxEntriesPerFile int
+	// HistorySize is the number of recent entries kept in memory. If it's zero, 1000 is used.
+	HistorySize int
+	// Logger logs failures of writing HAR files.
+	Logger Logger
+
+	mu          sync.Mutex
+	started     time.Time
+	seq         int
+	lastEntry   uint64
+	pending     []HAREntry
+	history     []HAREntry
+	subscribers map[chan HAREntry]bool
+}
+
+func (rec *Recorder) log(args ...interface{}) {
+	if rec.Logger != nil {
+		rec.Logger.Print(args...)
+	}
+}
+
+func (rec *Recorder) maxBodySize() int64 {
+	if rec.MaxBodySize == 0 {
+		return defaultMaxBodySize
+	}
+	return rec.MaxBodySize
+}
+
+// Middleware returns a Middleware that records requests and responses.
+// A response is recorded when its body is closed.
+func (rec *Recorder) Middleware() Middleware {
+	return func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			entry := rec.newEntry(req, start)
+			resp, err := h(req)
+			wait := time.Now()
+			entry.Timings.Wait = milliseconds(wait.Sub(start))
+			if err != nil {
+				entry.Comment = "request failed: " + err.Error()
+				entry.Response = HARResponse{Cookies: []HARCookie{}, Headers: []HARNameValue{}, HeadersSize: -1, BodySize: -1}
+				entry.Time = entry.Timings.Wait
+				rec.add(*entry)
+				return nil, err
+			}
+			resp.Body = &recordingBody{
+				ReadCloser: resp.Body,
+				limit:      rec.maxBodySize(),
+				onClose: func(body []byte, size int64, truncated bool) {
+					rec.finishEntry(entry, resp, body, size, truncated)
+					entry.Timings.Receive = milliseconds(time.Since(wait))
+					entry.Time = entry.Timings.Wait + entry.Timings.Receive
+					rec.add(*entry)
+				},
+			}
+			return resp, nil
+		}
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (rec *Recorder) newEntry(req *http.Request, start time.Time) *HAREntry {
+	entry := &HAREntry{
+		StartedDateTime: start,
+		Request: HARRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies(req.Cookies()),
+			Headers:     harHeaders(req.Header),
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    req.ContentLength,
+		},
+		Timings: HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			entry.Request.QueryString = append(entry.Request.QueryString, HARNameValue{Name: k, Value: v})
+		}
+	}
+	if flow := FlowFromContext(req.Context()); flow != nil {
+		entry.ID = flow.ID
+		entry.ClientAddress = flow.ClientAddr
+		entry.User = flow.User
+		if flow.TLS != nil {
+			entry.TLS = &HARTLS{
+				Version:     tlsVersionName(flow.TLS.Version),
+				CipherSuite: fmt.Sprintf("0x%04x", flow.TLS.CipherSuite),
+				ServerName:  flow.TLS.ServerName,
+			}
+		}
+	}
+	if req.Body != nil && req.Body != http.NoBody && rec.maxBodySize() > 0 {
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, rec.maxBodySize()+1))
+		truncated := int64(len(body)) > rec.maxBodySize()
+		req.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+		if truncated {
+			body = body[:rec.maxBodySize()]
+		} else if err == nil {
+			entry.Request.BodySize = int64(len(body))
+		}
+		text, encoding := harText(body)
+		entry.Request.PostData = &HARPostData{
+			MimeType:  req.Header.Get("Content-Type"),
+			Text:      text,
+			Encoding:  encoding,
+			Truncated: truncated,
+		}
+	}
+	return entry
+}
+
+func (rec *Recorder) finishEntry(entry *HAREntry, resp *http.Response, body []byte, size int64, truncated bool) {
+	entry.Response = HARResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies(resp.Cookies()),
+		Headers:     harHeaders(resp.Header),
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    size,
+		Content: HARContent{
+			Size:      size,
+			MimeType:  resp.Header.Get("Content-Type"),
+			Truncated: truncated,
+		},
+	}
+	if contentEncoding := resp.Header.Get("Content-Encoding"); contentEncoding != "" {
+		decoded, err := decodeContent(body, contentEncoding)
+		if err != nil || truncated {
+			entry.Response.Content.ContentEncoding = contentEncoding
+		} else {
+			body = decoded
+			entry.Response.Content.Size = int64(len(decoded))
+		}
+	}
+	entry.Response.Content.Text, entry.Response.Content.Encoding = harText(body)
+}
+
+func (rec *Recorder) add(entry HAREntry) {
+	rec.mu.Lock()
+	if rec.started.IsZero() {
+		rec.started = time.Now()
+	}
+	rec.lastEntry++
+	entry.Seq = rec.lastEntry
+	historySize := rec.HistorySize
+	if historySize == 0 {
+		historySize = defaultHistorySize
+	}
+	rec.history = append(rec.history, entry)
+	if len(rec.history) > historySize {
+		rec.history = append(rec.history[:0], rec.history[len(rec.history)-historySize:]...)
+	}
+	for c := range rec.subscribers {
+		select {
+		case c <- entry:
+		default:
+			// slow subscribers miss entries rather than blocking proxied requests.
+		}
+	}
+	var full []HAREntry
+	if rec.Dir != "" {
+		rec.pending = append(rec.pending, entry)
+		maxEntries := rec.MaxEntriesPerFile
+		if maxEntries == 0 {
+			maxEntries = defaultMaxEntriesPerFile
+		}
+		if len(rec.pending) >= maxEntries {
+			full, rec.pending = rec.pending, nil
+		}
+	}
+	rec.mu.Unlock()
+
+	if full != nil {
+		if err := rec.writeFile(full); err != nil {
+			rec.log("failed to write HAR file: ", err)
+		}
+	}
+}
+
+// Entries returns recently recorded entries from the oldest.
+func (rec *Recorder) Entries() []HAREntry {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	entries := make([]HAREntry, len(rec.history))
+	copy(entries, rec.history)
+	return entries
+}
+
+// Subscribe returns a channel receiving entries recorded after the call.
+// Entries are dropped if the receiver is slower than buffer entries. Call cancel to stop receiving.
+func (rec *Recorder) Subscribe(buffer int) (entries <-chan HAREntry, cancel func()) {
+	c := make(chan HAREntry, buffer)
+	rec.mu.Lock()
+	if rec.subscribers == nil {
+		rec.subscribers = make(map[chan HAREntry]bool)
+	}
+	rec.subscribers[c] = true
+	rec.mu.Unlock()
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			rec.mu.Lock()
+			delete(rec.subscribers, c)
+			rec.mu.Unlock()
+		})
+	}
+}
+
+// Clear forgets entries kept in memory. Entries not written to files yet are kept.
+func (rec *Recorder) Clear() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.history = nil
+}
+
+// Export writes entries kept in memory to w as a HAR.
+func (rec *Recorder) Export(w io.Writer) error {
+	return newHAR(rec.Entries()).Write(w)
+}
+
+// Flush writes entries not written yet to a new HAR file in Dir.
+func (rec *Recorder) Flush() error {
+	rec.mu.Lock()
+	entries := rec.pending
+	rec.pending = nil
+	rec.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	return rec.writeFile(entries)
+}
+
+func (rec *Recorder) writeFile(entries []HAREntry) error {
+	rec.mu.Lock()
+	rec.seq++
+	name := fmt.Sprintf("groxy-%s-%04d.har", rec.started.Format("20060102-150405"), rec.seq)
+	rec.mu.Unlock()
+
+	// HAR files contain credentials and cookies, so only the owner can read them.
+	if err := os.MkdirAll(rec.Dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create HAR directory")
+	}
+	f, err := os.OpenFile(filepath.Join(rec.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create HAR file")
+	}
+	if err := newHAR(entries).Write(f); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write HAR file")
+	}
+	return f.Close()
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// recordingBody keeps the first limit bytes read from the body, and calls onClose once when it's closed.
+type recordingBody struct {
+	io.ReadCloser
+	limit     int64
+	buf       bytes.Buffer
+	size      int64
+	truncated bool
+	closeOnce sync.Once
+	onClose   func(body []byte, size int64, truncated bool)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if rest := b.limit - int64(b.buf.Len()); rest > 0 {
+		if int64(n) > rest {
+			b.buf.Write(p[:rest])
+			b.truncated = true
+		} else {
+			b.buf.Write(p[:n])
+		}
+	} else if n > 0 && b.limit > 0 {
+		b.truncated = true
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.closeOnce.Do(func() {
+		b.onClose(b.buf.Bytes(), b.size, b.truncated)
+	})
+	return err
+}
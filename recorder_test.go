@@ -0,0 +1,134 @@
+package groxy
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(w)
+			gw.Write(body)
+			gw.Close()
+			return
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "groxy-har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := &Recorder{Dir: dir, MaxEntriesPerFile: 2, MaxBodySize: 64}
+	proxy := ProxyServer{HTTPSAction: HTTPSActionMITM}
+	proxy.Use(rec.Middleware())
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyurl),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	for _, c := range []struct{ path, body string }{
+		{"/echo?q=1", "hello"},
+		{"/gzip", "gzipped"},
+		{"/large", strings.Repeat("x", 100)},
+	} {
+		resp, err := client.Post(ts.URL+c.path, "text/plain", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	entries := rec.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected %d entries are recorded, but got %d", 3, len(entries))
+	}
+	echo := entries[0]
+	if echo.ID == "" || echo.TLS == nil {
+		t.Errorf("expected flow details are recorded, but got ID %q and TLS %v", echo.ID, echo.TLS)
+	}
+	if echo.Request.Method != "POST" || echo.Request.PostData == nil || echo.Request.PostData.Text != "hello" {
+		t.Errorf("unexpected recorded request: %+v", echo.Request)
+	}
+	if len(echo.Request.QueryString) != 1 || echo.Request.QueryString[0].Value != "1" {
+		t.Errorf("unexpected recorded query string: %+v", echo.Request.QueryString)
+	}
+	if echo.Response.Status != http.StatusOK || echo.Response.Content.Text != "hello" {
+		t.Errorf("unexpected recorded response: %+v", echo.Response)
+	}
+	if got := entries[1].Response.Content.Text; got != "gzipped" {
+		t.Errorf("expected gzipped body is decoded to %q, but got %q", "gzipped", got)
+	}
+	large := entries[2]
+	if !large.Request.PostData.Truncated || !large.Response.Content.Truncated || large.Response.Content.Text != strings.Repeat("x", 64) {
+		t.Errorf("expected bodies are truncated, but got %+v and %+v", large.Request.PostData, large.Response.Content)
+	}
+
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	if len(files) != 2 {
+		t.Fatalf("expected HAR files are rotated into %d files, but got %v", 2, files)
+	}
+	total := 0
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("expected HAR files are readable only by the owner, but got %v", fi.Mode())
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		har, err := ReadHAR(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("failed to read HAR file: %v", err)
+		}
+		if har.Log.Version != "1.2" {
+			t.Errorf("expected HAR version is %q, but got %q", "1.2", har.Log.Version)
+		}
+		total += len(har.Log.Entries)
+	}
+	if total != 3 {
+		t.Errorf("expected %d entries are written, but got %d", 3, total)
+	}
+
+	// sequence numbers identify entries even after they are cleared.
+	rec.Clear()
+	resp, err := client.Post(ts.URL+"/echo", "text/plain", strings.NewReader("again"))
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	resp.Body.Close()
+	if entries := rec.Entries(); len(entries) != 1 || entries[0].Seq != 4 {
+		t.Errorf("expected the entry after clearing has sequence number %d, but got %+v", 4, entries)
+	}
+}
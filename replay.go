@@ -0,0 +1,237 @@
+package groxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Replayer serves responses recorded in HAR files instead of requesting target servers.
+// It's useful to run tests offline against recorded traffic.
+//
+// A request matches an entry if their methods and URLs equal, and optionally their headers and bodies.
+// Query parameters are compared regardless of their order.
+// If several entries match a request, they are served in recorded order, and the last one is repeated.
+type Replayer struct {
+	// MatchHeaders lists headers whose values must be equal.
+	MatchHeaders []string
+	// IgnoreQuery ignores query strings of URLs.
+	IgnoreQuery bool
+	// MatchBody compares SHA-256 hashes of request bodies.
+	MatchBody bool
+	// PassThrough sends unmatched requests to target servers.
+	// If it's false, unmatched requests get http.StatusBadGateway.
+	PassThrough bool
+
+	mu      sync.Mutex
+	entries []HAREntry
+	served  []bool
+}
+
+// NewReplayer creates a Replayer serving entries of hars.
+func NewReplayer(hars ...*HAR) *Replayer {
+	rp := &Replayer{}
+	for _, h := range hars {
+		rp.entries = append(rp.entries, h.Log.Entries...)
+	}
+	rp.served = make([]bool, len(rp.entries))
+	return rp
+}
+
+// LoadReplayer creates a Replayer serving entries of HAR files.
+func LoadReplayer(filenames ...string) (*Replayer, error) {
+	hars := make([]*HAR, 0, len(filenames))
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open HAR file")
+		}
+		h, err := ReadHAR(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read HAR file %s", filename)
+		}
+		hars = append(hars, h)
+	}
+	return NewReplayer(hars...), nil
+}
+
+// Reset makes all entries servable again from the first ones.
+func (rp *Replayer) Reset() {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.served = make([]bool, len(rp.entries))
+}
+
+// Middleware returns a Middleware that serves recorded responses.
+func (rp *Replayer) Middleware() Middleware {
+	return func(h Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			entry, err := rp.find(req)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				return replayResponse(req, entry)
+			}
+			if rp.PassThrough {
+				return h(req)
+			}
+			return replayMiss(req), nil
+		}
+	}
+}
+
+// Handler returns a Handler that serves recorded responses regardless of PassThrough,
+// and responds http.StatusBadGateway to unmatched requests.
+func (rp *Replayer) Handler() Handler {
+	return rp.Middleware()(func(req *http.Request) (*http.Response, error) {
+		return replayMiss(req), nil
+	})
+}
+
+func replayMiss(req *http.Request) *http.Response {
+	msg := "no recorded response for " + req.Method + " " + req.URL.String() + "\n"
+	return NewResponse(req, http.StatusBadGateway, "text/plain; charset=utf-8", []byte(msg))
+}
+
+type replayKey struct {
+	method, url, headers string
+	bodyHash             [sha256.Size]byte
+}
+
+func (rp *Replayer) normalizeURL(u *url.URL) string {
+	nu := *u
+	nu.Fragment = ""
+	if rp.IgnoreQuery {
+		nu.RawQuery = ""
+	} else {
+		nu.RawQuery = nu.Query().Encode()
+	}
+	return nu.String()
+}
+
+func (rp *Replayer) headerKey(get func(string) []string) string {
+	var parts []string
+	for _, name := range rp.MatchHeaders {
+		parts = append(parts, strings.ToLower(name)+"="+strings.Join(get(name), ","))
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (rp *Replayer) requestKey(req *http.Request) (replayKey, error) {
+	key := replayKey{
+		method:  req.Method,
+		url:     rp.normalizeURL(req.URL),
+		headers: rp.headerKey(func(name string) []string { return req.Header[http.CanonicalHeaderKey(name)] }),
+	}
+	if rp.MatchBody {
+		var body []byte
+		if req.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return key, errors.Wrap(err, "failed to read request body")
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		key.bodyHash = sha256.Sum256(body)
+	}
+	return key, nil
+}
+
+// entryKey returns the key of entry, or false if the entry cannot be replayed.
+func (rp *Replayer) entryKey(entry *HAREntry) (replayKey, bool) {
+	// failed requests are recorded without responses.
+	if entry.Response.Status == 0 {
+		return replayKey{}, false
+	}
+	u, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return replayKey{}, false
+	}
+	key := replayKey{
+		method: entry.Request.Method,
+		url:    rp.normalizeURL(u),
+		headers: rp.headerKey(func(name string) []string {
+			var vs []string
+			for _, h := range entry.Request.Headers {
+				if strings.EqualFold(h.Name, name) {
+					vs = append(vs, h.Value)
+				}
+			}
+			return vs
+		}),
+	}
+	if rp.MatchBody {
+		var body []byte
+		if pd := entry.Request.PostData; pd != nil {
+			if pd.Truncated {
+				return key, false
+			}
+			if body, err = decodeText(pd.Text, pd.Encoding); err != nil {
+				return key, false
+			}
+		}
+		key.bodyHash = sha256.Sum256(body)
+	}
+	return key, true
+}
+
+// find returns the entry to serve for req, or nil if there is no such entry.
+func (rp *Replayer) find(req *http.Request) (*HAREntry, error) {
+	key, err := rp.requestKey(req)
+	if err != nil {
+		return nil, err
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	last := -1
+	for i := range rp.entries {
+		if k, ok := rp.entryKey(&rp.entries[i]); !ok || k != key {
+			continue
+		}
+		last = i
+		if !rp.served[i] {
+			rp.served[i] = true
+			return &rp.entries[i], nil
+		}
+	}
+	if last < 0 {
+		return nil, nil
+	}
+	return &rp.entries[last], nil
+}
+
+func replayResponse(req *http.Request, entry *HAREntry) (*http.Response, error) {
+	content := entry.Response.Content
+	body, err := decodeText(content.Text, content.Encoding)
+	if err != nil {
+		return nil, errors.Wrap(err, "broken recorded response body")
+	}
+	resp := NewResponse(req, entry.Response.Status, "", body)
+	for _, h := range entry.Response.Headers {
+		switch http.CanonicalHeaderKey(h.Name) {
+		case "Content-Length", "Transfer-Encoding":
+			// they are set for the body by NewResponse.
+		case "Content-Encoding":
+			// recorded bodies are decoded unless the recorder failed to.
+			if content.ContentEncoding != "" {
+				resp.Header.Add(h.Name, h.Value)
+			}
+		default:
+			resp.Header.Add(h.Name, h.Value)
+		}
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp, nil
+}
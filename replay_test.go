@@ -0,0 +1,89 @@
+package groxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Count", strings.Repeat("i", count))
+		w.Write([]byte(r.URL.RawQuery + ":" + string(body)))
+	}))
+	defer ts.Close()
+
+	// record traffic.
+	rec := &Recorder{}
+	var recording ProxyServer
+	recording.Use(rec.Middleware())
+	recordingserver := httptest.NewServer(&recording)
+	defer recordingserver.Close()
+	recordingurl, _ := url.Parse(recordingserver.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(recordingurl)}}
+	for _, c := range []struct{ query, body string }{{"a=1&b=2", "first"}, {"a=1&b=2", "second"}, {"a=1&b=2", "first"}} {
+		resp, err := client.Post(ts.URL+"/api?"+c.query, "text/plain", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	var buf bytes.Buffer
+	if err := rec.Export(&buf); err != nil {
+		t.Fatalf("failed to export HAR: %v", err)
+	}
+	har, err := ReadHAR(&buf)
+	if err != nil {
+		t.Fatalf("failed to read HAR: %v", err)
+	}
+	ts.Close()
+
+	// replay it without the server.
+	rp := NewReplayer(har)
+	rp.MatchBody = true
+	var replaying ProxyServer
+	replaying.Use(rp.Middleware())
+	replayingserver := httptest.NewServer(&replaying)
+	defer replayingserver.Close()
+	replayingurl, _ := url.Parse(replayingserver.URL)
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(replayingurl)}}
+
+	cases := []struct {
+		query, body string
+		code        int
+		expected    string
+		count       string
+	}{
+		{"b=2&a=1", "first", http.StatusOK, "a=1&b=2:first", "i"},
+		{"a=1&b=2", "first", http.StatusOK, "a=1&b=2:first", "iii"},
+		{"a=1&b=2", "first", http.StatusOK, "a=1&b=2:first", "iii"},
+		{"a=1&b=2", "second", http.StatusOK, "a=1&b=2:second", "ii"},
+		{"a=1&b=2", "third", http.StatusBadGateway, "", ""},
+	}
+	for _, c := range cases {
+		resp, err := client.Post(ts.URL+"/api?"+c.query, "text/plain", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("%s %s: expected status code is %v, but got %v", c.query, c.body, c.code, resp.StatusCode)
+			continue
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+		if string(body) != c.expected || resp.Header.Get("X-Count") != c.count {
+			t.Errorf("%s %s: expected response is %q (%s), but got %q (%s)", c.query, c.body, c.expected, c.count, string(body), resp.Header.Get("X-Count"))
+		}
+	}
+}
@@ -2,12 +2,19 @@ package groxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -25,7 +32,88 @@ const (
 	HTTPSActionMITM
 )
 
+func (a HTTPSAction) String() string {
+	switch a {
+	case HTTPSActionProxy:
+		return "proxy"
+	case HTTPSActionReject:
+		return "reject"
+	case HTTPSActionMITM:
+		return "mitm"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseHTTPSAction parses the name of an HTTPSAction, i.e. "proxy", "reject" or "mitm".
+func ParseHTTPSAction(s string) (HTTPSAction, error) {
+	for _, a := range []HTTPSAction{HTTPSActionProxy, HTTPSActionReject, HTTPSActionMITM} {
+		if strings.EqualFold(s, a.String()) {
+			return a, nil
+		}
+	}
+	return 0, errors.Errorf("unknown HTTPS action: %q", s)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (a HTTPSAction) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (a *HTTPSAction) UnmarshalText(text []byte) error {
+	action, err := ParseHTTPSAction(string(text))
+	if err != nil {
+		return err
+	}
+	*a = action
+	return nil
+}
+
+// ConnectAction is an action for a CONNECT request decided by ConnectHandler.
+type ConnectAction int
+
+const (
+	// ConnectDefault applies ProxyServer.HTTPSAction.
+	ConnectDefault ConnectAction = iota
+	// ConnectProxy tunnels the connection like HTTPSActionProxy.
+	ConnectProxy
+	// ConnectReject rejects the request like HTTPSActionReject.
+	ConnectReject
+	// ConnectMITM strips SSL encryption like HTTPSActionMITM.
+	ConnectMITM
+)
+
+func (a HTTPSAction) connectAction() ConnectAction {
+	switch a {
+	case HTTPSActionProxy:
+		return ConnectProxy
+	case HTTPSActionReject:
+		return ConnectReject
+	case HTTPSActionMITM:
+		return ConnectMITM
+	default:
+		return ConnectAction(-1)
+	}
+}
+
+// ConnectDecision is how to handle a CONNECT request.
+type ConnectDecision struct {
+	// Action is an action for the request. The zero value applies ProxyServer.HTTPSAction,
+	// so a handler can redirect requests by setting only Host.
+	Action ConnectAction
+	// Host is a "host:port" to connect instead of the requested one, if it's not empty.
+	// Requests of MITM sessions are sent to it as well, keeping their Host headers.
+	Host string
+}
+
+// ConnectHandler decides how to handle a CONNECT request.
+// It's called after the port and host restrictions, so it can see only allowed requests.
+type ConnectHandler func(r *http.Request) ConnectDecision
+
 // ProxyServer is a programmable proxy server instance, behaves as an http.Handler.
+//
+// Fields must not be changed while serving, except by Reconfigure for the ones it allows.
 type ProxyServer struct {
 	// Logger is a logger that prints proxy requests.
 	Logger Logger
@@ -33,12 +121,167 @@ type ProxyServer struct {
 	// If it's nil, non-proxy requests causes http.StatusBadRequest.
 	NonProxyRequestHandler http.Handler
 	HTTPSAction            HTTPSAction
-	middlewares            []Middleware
+	// CA is the certificate authority of MITM sessions.
+	// If it's a CA certificate, certificates of requested hosts are signed by it and presented to clients,
+	// so that clients trusting it can verify them. Otherwise, it's presented to clients as is.
+	// If it's nil, the builtin certificate is presented as is.
+	CA *tls.Certificate
+	// UpstreamProxy is a proxy server that requests and tunnels are sent via.
+	// If it's nil, proxies set by environment variables are used (see http.ProxyFromEnvironment).
+	UpstreamProxy *url.URL
+	// ClientACL restricts clients by their addresses. It's checked before any other processing.
+	// If it's nil, all clients are allowed.
+	ClientACL *ACL
+	// ConnectPorts restricts destination ports of CONNECT requests.
+	// If it's nil, CONNECT to any port is allowed.
+	ConnectPorts *PortPolicy
+	// Blocker blocks proxy requests and CONNECT requests by their destination hosts.
+	// If it's nil, no hosts are blocked.
+	Blocker *Blocker
+	// ConnectHandler decides how to handle each CONNECT request.
+	// If it's nil, HTTPSAction is applied to all CONNECT requests.
+	ConnectHandler ConnectHandler
+	// OnTunnelOpen is called when a tunnel or a MITM session is established.
+	OnTunnelOpen func(ConnInfo)
+	// OnTunnelClose is called when a tunnel or a MITM session is closed, with its final byte counts.
+	OnTunnelClose func(ConnInfo)
+	// Authenticator authenticates proxy requests and CONNECT requests.
+	// If it's nil, all requests are accepted.
+	Authenticator Authenticator
+	// DestinationPolicy restricts destination servers of HTTP requests, tunnels and MITM sessions.
+	// If it's nil, any destination is allowed.
+	DestinationPolicy *DestinationPolicy
+	// Transport performs proxied requests for both HTTP and hijacked HTTPS connections.
+	// If it's nil, a transport shared among all connections of the server is used.
+	Transport http.RoundTripper
+	// DialTimeout limits the time to connect to destination servers.
+	// If it's zero, 30 seconds is used.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout limits the time of TLS handshakes with clients and destination servers.
+	// If it's zero, 10 seconds is used.
+	TLSHandshakeTimeout time.Duration
+	// IdleTimeout closes hijacked connections that transfer no data for the duration.
+	// If it's zero, there is no idle timeout.
+	IdleTimeout time.Duration
+	// MaxConnLifetime closes hijacked connections after the duration since they are established.
+	// If it's zero, there is no limit.
+	MaxConnLifetime time.Duration
+	// Middlewares wrap handlers of proxy requests and MITM requests.
+	Middlewares Chain
+
+	// reconfigureMu guards fields that can be changed by Reconfigure.
+	reconfigureMu sync.RWMutex
+
+	transportOnce    sync.Once
+	defaultTransport *http.Transport
+
+	leaves leafCertificates
+
+	mu           sync.Mutex
+	conns        map[uint64]*hijackedConn
+	lastConnID   uint64
+	shuttingDown bool
+}
+
+// reconfigurable is a snapshot of fields of ProxyServer that can be changed by Reconfigure.
+type reconfigurable struct {
+	httpsAction       HTTPSAction
+	ca                *tls.Certificate
+	upstreamProxy     *url.URL
+	clientACL         *ACL
+	connectPorts      *PortPolicy
+	blocker           *Blocker
+	connectHandler    ConnectHandler
+	authenticator     Authenticator
+	destinationPolicy *DestinationPolicy
+}
+
+func (p *ProxyServer) current() reconfigurable {
+	p.reconfigureMu.RLock()
+	defer p.reconfigureMu.RUnlock()
+	return reconfigurable{
+		httpsAction:       p.HTTPSAction,
+		ca:                p.CA,
+		upstreamProxy:     p.UpstreamProxy,
+		clientACL:         p.ClientACL,
+		connectPorts:      p.ConnectPorts,
+		blocker:           p.Blocker,
+		connectHandler:    p.ConnectHandler,
+		authenticator:     p.Authenticator,
+		destinationPolicy: p.DestinationPolicy,
+	}
 }
 
-// Use adds given middlewares to p's middlewares.
+// Reconfigure calls f to change fields of p while it's serving.
+// HTTPSAction, CA, UpstreamProxy, ClientACL, ConnectPorts, Blocker, ConnectHandler, Authenticator and
+// DestinationPolicy can be changed, and the changes are applied to new requests.
+// Established tunnels and MITM sessions are kept. Use p.Middlewares to change middlewares.
+func (p *ProxyServer) Reconfigure(f func(p *ProxyServer)) {
+	p.reconfigureMu.Lock()
+	defer p.reconfigureMu.Unlock()
+	f(p)
+}
+
+// Use adds given middlewares to the innermost of p's middlewares.
+// The first added middleware is the outermost one, which receives requests first and responses last.
 func (p *ProxyServer) Use(ms ...Middleware) {
-	p.middlewares = append(p.middlewares, ms...)
+	p.Middlewares.Use(ms...)
+}
+
+func (p *ProxyServer) transport() http.RoundTripper {
+	if p.Transport != nil {
+		return p.Transport
+	}
+	p.transportOnce.Do(func() {
+		p.defaultTransport = &http.Transport{
+			Proxy:                 p.proxyURL,
+			DialContext:           p.dialTransport,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   p.tlsHandshakeTimeout(),
+			ExpectContinueTimeout: 1 * time.Second,
+			// clients of MITM connections already accept insecure certificates, so upstream ones are not verified either.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	})
+	return p.defaultTransport
+}
+
+// CloseIdleConnections closes idle connections to destination servers kept by p's transport.
+func (p *ProxyServer) CloseIdleConnections() {
+	if tr, ok := p.transport().(interface {
+		CloseIdleConnections()
+	}); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// DialContext connects to addr respecting p.DialTimeout and p.DestinationPolicy.
+// Custom transports set to p.Transport should use it for dialing.
+func (p *ProxyServer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := p.dialer()
+	if dp := p.current().destinationPolicy; dp != nil {
+		return dp.dial(ctx, d, network, addr)
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+func (p *ProxyServer) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: p.dialTimeout(), KeepAlive: 30 * time.Second}
+}
+
+func (p *ProxyServer) dialTimeout() time.Duration {
+	if p.DialTimeout == 0 {
+		return defaultDialTimeout
+	}
+	return p.DialTimeout
+}
+
+func (p *ProxyServer) tlsHandshakeTimeout() time.Duration {
+	if p.TLSHandshakeTimeout == 0 {
+		return defaultTLSHandshakeTimeout
+	}
+	return p.TLSHandshakeTimeout
 }
 
 func (p *ProxyServer) log(args ...interface{}) {
@@ -47,6 +290,35 @@ func (p *ProxyServer) log(args ...interface{}) {
 	}
 }
 
+// hopHeaders are headers for a single connection, which must not be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func copyRequestHeader(dst, src http.Header) {
+	for k, vs := range src {
+		for _, v := range vs {
+			dst.Add(k, v)
+		}
+	}
+	for _, f := range dst["Connection"] {
+		for _, k := range strings.Split(f, ",") {
+			dst.Del(strings.TrimSpace(k))
+		}
+	}
+	for _, k := range hopHeaders {
+		dst.Del(k)
+	}
+}
+
 func copyResponse(dst http.ResponseWriter, src *http.Response) error {
 	dstHeader := dst.Header()
 	for k := range dstHeader {
@@ -64,117 +336,280 @@ func copyResponse(dst http.ResponseWriter, src *http.Response) error {
 	return nil
 }
 
-func (p *ProxyServer) pipeConn(dst, src *net.TCPConn) {
-	if _, err := io.Copy(dst, src); err != nil {
-		p.log("failed to pipe connections: ", err)
+func (p *ProxyServer) apply(base Handler) Handler {
+	h := p.Middlewares.Then(base)
+	return func(req *http.Request) (*http.Response, error) {
+		resp, err := h(req)
+		if err == nil && resp == nil {
+			// a broken middleware must not crash the proxy.
+			return nil, errors.New("middleware returned no response")
+		}
+		return resp, err
 	}
-	dst.CloseWrite()
-	src.CloseRead()
 }
 
-func (p *ProxyServer) apply(base Handler) Handler {
-	for _, m := range p.middlewares {
-		base = m(base)
+// dialDestination connects to addr, the destination of the CONNECT request r.
+// If it fails, it responds an error status to w, and returns nil.
+func (p *ProxyServer) dialDestination(w http.ResponseWriter, r *http.Request, addr string) net.Conn {
+	dstConn, err := p.dialTunnel(r.Context(), addr)
+	if err != nil {
+		p.log("failed to connect ", addr, ": ", err)
+		http.Error(w, fmt.Sprintf("failed to connect the destination server: %v", err), errorStatus(err))
+		return nil
+	}
+	return dstConn
+}
+
+// errorStatus returns the status code to respond when connecting or requesting the destination server fails with err.
+func errorStatus(err error) int {
+	if isDestinationError(err) {
+		return http.StatusForbidden
 	}
-	return base
+	if ne, ok := errors.Cause(err).(net.Error); ok && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
 }
 
-func (p *ProxyServer) proxyHTTPS(w http.ResponseWriter, r *http.Request) {
+// proxyHTTPS tunnels the CONNECT request r.
+// If redirect is not empty, the tunnel is connected to it instead of the requested host.
+func (p *ProxyServer) proxyHTTPS(w http.ResponseWriter, r *http.Request, redirect string) {
 	hij, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "cannot hijack https request", http.StatusInternalServerError)
 		return
 	}
+	addr := r.URL.Host
+	if redirect != "" {
+		addr = redirect
+	}
+	dstConn := p.dialDestination(w, r, addr)
+	if dstConn == nil {
+		return
+	}
 	cliConn, _, err := hij.Hijack()
 	if err != nil {
+		dstConn.Close()
 		http.Error(w, fmt.Sprintf("failed to hijack https connection: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	cliConn.Write([]byte("HTTP/1.0 200 OK \r\n\r\n"))
+	cliConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 
-	dstConn, err := net.Dial("tcp", r.URL.Host)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to connect the destination server: %v", err), http.StatusBadGateway)
-		return
+	p.log("accept CONNECT to ", addr)
+	if conn := p.newHijackedConn(ConnKindTunnel, r.URL.Host, redirect, cliConn, dstConn); conn != nil {
+		conn.tunnel()
 	}
-	dstTCPConn := dstConn.(*net.TCPConn)
-	cliTCPConn := cliConn.(*net.TCPConn)
-
-	go p.pipeConn(dstTCPConn, cliTCPConn)
-	go p.pipeConn(cliTCPConn, dstTCPConn)
-
-	p.log("accept CONNECT to ", r.URL.Host)
 }
 
-func (p *ProxyServer) mitmHTTPS(w http.ResponseWriter, r *http.Request) {
+// mitmHTTPS hijacks the CONNECT request r and handles decrypted requests.
+// If redirect is not empty, the requests are sent to it instead of their Host.
+func (p *ProxyServer) mitmHTTPS(w http.ResponseWriter, r *http.Request, redirect string) {
 	hij, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "cannot hijack https request", http.StatusInternalServerError)
 		return
 	}
+	// the destination is checked before the session is established, as tunnels are, so that clients get 502/504 for
+	// CONNECT requests. Requests are sent via p's transport, so the connection is used only for the check.
+	// Redirected sessions are not checked since their requests may be served without the destination.
+	if redirect == "" {
+		dstConn := p.dialDestination(w, r, r.URL.Host)
+		if dstConn == nil {
+			return
+		}
+		dstConn.Close()
+	}
 	cliConn, _, err := hij.Hijack()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to hijack https connection: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	cliConn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-	tlsConfig := &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{groxyCa}}
-	rawCli := tls.Server(cliConn, tlsConfig)
-	defer rawCli.Close()
+	cliConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{groxyCa}}
+	if ca := p.current().ca; ca != nil {
+		host := requestHost(r)
+		tlsConfig = &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// clients may not send SNI, e.g. when they connect to IP addresses.
+			if hello.ServerName != "" {
+				return p.leaves.get(ca, hello.ServerName)
+			}
+			return p.leaves.get(ca, host)
+		}}
+	}
+	conn := p.newHijackedConn(ConnKindMITM, r.URL.Host, redirect, cliConn, nil)
+	if conn == nil {
+		return
+	}
+	rawCli := tls.Server(conn.client, tlsConfig)
+	rawCli.SetDeadline(time.Now().Add(p.tlsHandshakeTimeout()))
+	if err := rawCli.Handshake(); err != nil {
+		conn.close("TLS handshake failed: " + err.Error())
+		return
+	}
+	rawCli.SetDeadline(time.Time{})
+	conn.close(p.serveMITM(r.Context(), conn, rawCli))
+}
+
+// serveMITM handles requests on the decrypted client connection, and returns the reason to finish.
+// Each request is given ctx, the context of the CONNECT request.
+func (p *ProxyServer) serveMITM(ctx context.Context, conn *hijackedConn, rawCli *tls.Conn) string {
 	cliReader := bufio.NewReader(rawCli)
-	mitmTr := &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
-	handler := p.apply(DefaultHTTPSHandler(mitmTr))
+	// the context of the previous request is cancelled after its response is written.
+	cancel := func() {}
+	defer func() { cancel() }()
 	for {
+		cancel()
+		if p.IdleTimeout > 0 {
+			rawCli.SetReadDeadline(time.Now().Add(p.IdleTimeout))
+		}
 		req, err := http.ReadRequest(cliReader)
 		if err != nil {
 			if err == io.EOF {
-				break
+				return "connection closed"
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return "idle timeout"
 			}
-			p.log("failed to read TLS request: ", err)
-			break
+			return "failed to read TLS request: " + err.Error()
 		}
+		rawCli.SetReadDeadline(time.Time{})
+		req.RemoteAddr = conn.client.RemoteAddr().String()
+		conn.touch()
+		if !conn.setBusy(true) {
+			// the connection is already closed by Shutdown, so the request cannot be served.
+			return "shutdown"
+		}
+		atomic.AddInt64(&conn.requests, 1)
+		var reqCtx context.Context
+		reqCtx, cancel = conn.requestContext(ctx)
+		bodyClosed := make(chan struct{})
+		if req.Body == http.NoBody {
+			close(bodyClosed)
+		} else {
+			req.Body = &closeNotifyBody{ReadCloser: req.Body, closed: bodyClosed}
+		}
+		stopWatching := conn.watchClient(rawCli, cliReader, bodyClosed)
 		req.URL.Host = req.Host
+		if conn.redirect != "" {
+			req.URL.Host = conn.redirect
+		}
 		req.URL.Scheme = "https"
-		resp, err := handler(req)
+		flow := newFlow(req)
+		flow.ConnID = conn.id
+		flow.ConnectHost = conn.host
+		state := rawCli.ConnectionState()
+		flow.TLS = &state
+		req = req.WithContext(withFlow(reqCtx, flow))
+		resp := p.rejectMITMRequest(conn, req)
+		if resp == nil {
+			resp, err = p.apply(p.roundTrip)(req)
+		}
 		if err != nil {
-			p.log("failed to read TLS response: ", err)
-			break
+			if errors.Cause(err) == ErrDropped {
+				stopWatching()
+				return "dropped by interceptor"
+			}
+			p.log("failed to request ", req.URL.Host, ": ", err)
+			resp = NewResponse(req, errorStatus(err), "text/plain; charset=utf-8", []byte(fmt.Sprintf("request failed: %v\n", err)))
 		}
+		flow.markResponseStart()
 		body, err := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
+		stopWatching()
 		if err != nil {
-			p.log("failed to read respnse body: ", err)
-			break
+			return "failed to read respnse body: " + err.Error()
+		}
+		// the body is already decoded from chunks or compressed by the transport, so its length must be sent instead.
+		resp.Header.Del("Transfer-Encoding")
+		if req.Method != "HEAD" {
+			resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
 		}
 		if _, err := io.WriteString(rawCli, "HTTP/1.1 "+resp.Status+"\r\n"); err != nil {
-			p.log("failed to write TLS response: ", err)
-			break
+			return "failed to write TLS response: " + err.Error()
+		}
+		if conn.isDraining() {
+			resp.Header.Set("Connection", "close")
 		}
 		resp.Header.Write(rawCli)
 		rawCli.Write([]byte("\r\n"))
 		rawCli.Write(body)
+		flow.markEnd()
+		conn.touch()
+		if !conn.setBusy(false) {
+			return "shutdown"
+		}
 	}
 }
 
-func (p *ProxyServer) connectHandler(w http.ResponseWriter, r *http.Request) {
-	switch p.HTTPSAction {
-	case HTTPSActionProxy:
-		p.proxyHTTPS(w, r)
-	case HTTPSActionReject:
+// rejectMITMRequest returns a response rejecting req of the MITM session conn if its destination is not permitted.
+// Requests of a session can name any host in their Host headers, so the restrictions of CONNECT requests are
+// applied to each of them unless the session is redirected by ConnectHandler.
+func (p *ProxyServer) rejectMITMRequest(conn *hijackedConn, req *http.Request) *http.Response {
+	if conn.redirect != "" {
+		return nil
+	}
+	cur := p.current()
+	if b := cur.blocker; b != nil && b.Blocks(req.URL.Host) {
+		p.log("blocked request to ", req.URL.Host, " from ", req.RemoteAddr)
+		return b.response(req)
+	}
+	if ports := cur.connectPorts; ports != nil && !ports.permitsAddr(withDefaultPort(req.URL.Host, "443")) {
+		p.log("rejected request to ", req.URL.Host, " from ", req.RemoteAddr, ": port is not allowed")
+		return NewResponse(req, http.StatusForbidden, "text/plain; charset=utf-8", []byte("request to the port is not allowed\n"))
+	}
+	return nil
+}
+
+func (p *ProxyServer) serveConnect(w http.ResponseWriter, r *http.Request) {
+	if p.isShuttingDown() {
+		http.Error(w, "proxy server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !p.permitsPort(w, r) || !p.permitsHost(w, r) {
+		return
+	}
+	cur := p.current()
+	var decision ConnectDecision
+	if cur.connectHandler != nil {
+		decision = cur.connectHandler(r)
+	}
+	action := decision.Action
+	if action == ConnectDefault {
+		action = cur.httpsAction.connectAction()
+	}
+	redirect := ""
+	if decision.Host != "" && decision.Host != r.URL.Host {
+		p.log("redirect CONNECT to ", r.URL.Host, " to ", decision.Host)
+		redirect = decision.Host
+	}
+	switch action {
+	case ConnectProxy:
+		p.proxyHTTPS(w, r, redirect)
+	case ConnectReject:
 		http.Error(w, "HTTPS request is not allowed", http.StatusBadRequest)
-	case HTTPSActionMITM:
-		p.mitmHTTPS(w, r)
+	case ConnectMITM:
+		p.mitmHTTPS(w, r, redirect)
 	default:
-		http.Error(w, fmt.Sprintf("unknown HTTPS action: %v", p.HTTPSAction), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("unknown HTTPS action: %v", action), http.StatusInternalServerError)
 	}
 }
 
 func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p.log("received request: ", r)
+	// the request is not logged as it is, since its Proxy-Authorization header has credentials.
+	p.log("received request: ", r.Method, " ", r.URL.Host, " from ", r.RemoteAddr)
+	if !p.permitsClient(w, r) {
+		return
+	}
+	if r.Method == "CONNECT" || r.URL.IsAbs() {
+		var ok bool
+		if r, ok = p.authenticate(w, r); !ok {
+			return
+		}
+	}
 	if r.Method == "CONNECT" {
-		p.connectHandler(w, r)
+		p.serveConnect(w, r)
 		return
 	}
 	if !r.URL.IsAbs() {
@@ -185,20 +620,31 @@ func (p *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if !p.permitsHost(w, r) {
+		return
+	}
 	proxyr, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("broken request format: %v", err), http.StatusBadRequest)
 		return
 	}
+	flow := newFlow(r)
+	proxyr = proxyr.WithContext(withFlow(r.Context(), flow))
+	copyRequestHeader(proxyr.Header, r.Header)
+	proxyr.ContentLength = r.ContentLength
+	proxyr.RemoteAddr = r.RemoteAddr
 
-	resp, err := p.apply(DefaultHTTPHandler)(proxyr)
+	resp, err := p.apply(p.roundTrip)(proxyr)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("request failed: %v", err), http.StatusBadGateway)
+		http.Error(w, fmt.Sprintf("request failed: %v", err), errorStatus(err))
 		return
 	}
 	defer resp.Body.Close()
+	flow.markResponseStart()
 
-	if err := copyResponse(w, resp); err != nil {
+	err = copyResponse(w, resp)
+	flow.markEnd()
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -1,13 +1,18 @@
 package groxy
 
 import (
+	"bufio"
 	"crypto/tls"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHTTPProxy(t *testing.T) {
@@ -114,6 +119,48 @@ func TestHTTPSManInTheMiddle(t *testing.T) {
 	}
 }
 
+func TestHTTPSManInTheMiddleHead(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	proxy := ProxyServer{HTTPSAction: HTTPSActionMITM}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyurl),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	// responses of HEAD requests have no body, but keep Content-Length of the resource.
+	resp, err := client.Head(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != 5 {
+		t.Errorf("expected Content-Length of the HEAD response is %d, but got %d", 5, resp.ContentLength)
+	}
+	// the session is still in sync after the HEAD response.
+	resp, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("failed to request via proxy: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("expected response body is %q, but got %q", "hello", string(body))
+	}
+}
+
 func TestHTTPSReject(t *testing.T) {
 	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
@@ -180,3 +227,139 @@ func TestNonProxyRequestWithHandler(t *testing.T) {
 		t.Errorf("expected response body is %q, but got %q", reply, string(gotbody))
 	}
 }
+
+type countingTransport struct {
+	count int
+	base  http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count++
+	return t.base.RoundTrip(req)
+}
+
+func TestCustomTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plain"))
+	}))
+	defer ts.Close()
+	tlsts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tls"))
+	}))
+	defer tlsts.Close()
+
+	tr := &countingTransport{base: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	proxy := ProxyServer{HTTPSAction: HTTPSActionMITM, Transport: tr}
+	proxyserver := httptest.NewServer(&proxy)
+	defer proxyserver.Close()
+	proxyurl, err := url.Parse(proxyserver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyurl),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	for _, u := range []string{ts.URL, tlsts.URL, tlsts.URL} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatalf("failed to request via proxy: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if tr.count != 3 {
+		t.Errorf("expected transport is used %d times, but got %d", 3, tr.count)
+	}
+}
+
+func TestConnectToUnreachableDestination(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	for _, action := range []HTTPSAction{HTTPSActionProxy, HTTPSActionMITM} {
+		proxy := ProxyServer{HTTPSAction: action}
+		proxyserver := httptest.NewServer(&proxy)
+		conn, resp := connect(t, proxyserver, addr)
+		conn.Close()
+		proxyserver.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected status code is %v, but got %v (action %v)", http.StatusBadGateway, resp.StatusCode, action)
+		}
+	}
+}
+
+// mitmGet sends a GET request for host on the MITM session conn, and returns its response.
+func mitmGet(t *testing.T, conn net.Conn, host string) *http.Response {
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("failed to read the MITM response: %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	tlsserver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tls"))
+	}))
+	defer tlsserver.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plain"))
+	}))
+	defer ts.Close()
+
+	var requests, tunnels int64
+	upstream := ProxyServer{OnTunnelOpen: func(ConnInfo) { atomic.AddInt64(&tunnels, 1) }}
+	upstream.Use(func(h Handler) Handler {
+		return func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt64(&requests, 1)
+			return h(r)
+		}
+	})
+	upstreamserver := httptest.NewServer(&upstream)
+	defer upstreamserver.Close()
+	upstreamurl, _ := url.Parse(upstreamserver.URL)
+
+	for _, action := range []HTTPSAction{HTTPSActionProxy, HTTPSActionMITM} {
+		proxy := ProxyServer{HTTPSAction: action, UpstreamProxy: upstreamurl}
+		proxyserver := httptest.NewServer(&proxy)
+		proxyurl, _ := url.Parse(proxyserver.URL)
+		client := &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyurl),
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+		for _, u := range []string{ts.URL, tlsserver.URL} {
+			resp, err := client.Get(u)
+			if err != nil {
+				t.Fatalf("failed to request via proxy: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected status code is %v, but got %v (action %v)", http.StatusOK, resp.StatusCode, action)
+			}
+		}
+		proxyserver.Close()
+	}
+	// plain HTTP requests are forwarded as proxy requests.
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("expected the upstream proxy receives 2 proxy requests, but got %d", n)
+	}
+	// the tunnel, and the reachability check and the request of the MITM session are sent via CONNECT.
+	if n := atomic.LoadInt64(&tunnels); n != 3 {
+		t.Errorf("expected the upstream proxy opens 3 tunnels, but got %d", n)
+	}
+}
@@ -0,0 +1,145 @@
+package groxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// upstreamDial records the address of the upstream proxy chosen for a request of p's transport,
+// so that the transport dials it without DestinationPolicy.
+type upstreamDial struct {
+	addr string
+}
+
+// proxyAddr returns the address to dial the proxy.
+func proxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	port := "80"
+	switch proxy.Scheme {
+	case "https":
+		port = "443"
+	case "socks5":
+		port = "1080"
+	}
+	return net.JoinHostPort(proxy.Hostname(), port)
+}
+
+// proxyURL returns the upstream proxy for req, or nil if req should be sent directly.
+// If req is sent via the upstream proxy, its destination is checked by p.DestinationPolicy here
+// because only the upstream proxy is dialed. The upstream proxy itself is chosen by the operator,
+// so it's not restricted by the policy.
+func (p *ProxyServer) proxyURL(req *http.Request) (*url.URL, error) {
+	cur := p.current()
+	proxy := cur.upstreamProxy
+	if proxy == nil {
+		var err error
+		if proxy, err = http.ProxyFromEnvironment(req); err != nil || proxy == nil {
+			return proxy, err
+		}
+	}
+	if dp := cur.destinationPolicy; dp != nil {
+		if err := dp.check(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	if d, ok := req.Context().Value(upstreamContextKey).(*upstreamDial); ok {
+		d.addr = proxyAddr(proxy)
+	}
+	return proxy, nil
+}
+
+// dialTransport dials addr for p's transport. Upstream proxies are dialed without DestinationPolicy.
+func (p *ProxyServer) dialTransport(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d, ok := ctx.Value(upstreamContextKey).(*upstreamDial); ok && d.addr == addr {
+		return p.dialer().DialContext(ctx, network, addr)
+	}
+	return p.DialContext(ctx, network, addr)
+}
+
+// roundTrip sends req by p's transport. It's the innermost Handler of p's middlewares.
+func (p *ProxyServer) roundTrip(req *http.Request) (*http.Response, error) {
+	if p.Transport == nil {
+		req = req.WithContext(context.WithValue(req.Context(), upstreamContextKey, &upstreamDial{}))
+	}
+	return p.transport().RoundTrip(req)
+}
+
+// dialTunnel connects to addr for a CONNECT request, directly or via the upstream proxy.
+func (p *ProxyServer) dialTunnel(ctx context.Context, addr string) (net.Conn, error) {
+	req := (&http.Request{URL: &url.URL{Scheme: "https", Host: addr}}).WithContext(ctx)
+	proxy, err := p.proxyURL(req)
+	if err != nil {
+		if isDestinationError(err) {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "invalid upstream proxy")
+	}
+	if proxy == nil {
+		return p.DialContext(ctx, "tcp", addr)
+	}
+	if proxy.Scheme != "http" {
+		return nil, errors.Errorf("unsupported upstream proxy scheme: %q", proxy.Scheme)
+	}
+	conn, err := p.dialer().DialContext(ctx, "tcp", proxyAddr(proxy))
+	if err != nil {
+		return nil, err
+	}
+	req = &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	conn.SetDeadline(time.Now().Add(p.dialTimeout()))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to send CONNECT to the upstream proxy")
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to read CONNECT response of the upstream proxy")
+	}
+	resp.Body.Close()
+	conn.SetDeadline(time.Time{})
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("upstream proxy refused CONNECT: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// the destination server may have sent data already.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose first bytes are buffered in r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
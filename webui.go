@@ -0,0 +1,359 @@
+package groxy
+
+import "net/http"
+
+func serveWebUI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		methodNotAllowed(w, "GET", "HEAD")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(webUI))
+}
+
+// webUI is a single page inspector of flows, which uses only the admin API without any external assets.
+const webUI = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>groxy</title>
+<style>
+* { box-sizing: border-box; }
+body { margin: 0; font: 13px -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #222; display: flex; flex-direction: column; height: 100vh; }
+header { display: flex; align-items: center; gap: 8px; padding: 6px 10px; background: #2d3e50; color: #fff; }
+header h1 { font-size: 15px; margin: 0 12px 0 0; }
+header input { flex: 1; padding: 4px 6px; border: 0; border-radius: 3px; font: inherit; }
+header button, header select { font: inherit; padding: 3px 8px; }
+#status { font-size: 12px; min-width: 70px; text-align: right; }
+main { flex: 1; display: flex; min-height: 0; }
+#list { flex: 1; overflow: auto; }
+#detail { flex: 1; overflow: auto; border-left: 1px solid #ccc; padding: 8px 12px; display: none; }
+#detail.open { display: block; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 3px 6px; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; max-width: 420px; }
+th { position: sticky; top: 0; background: #eef1f4; border-bottom: 1px solid #ccc; }
+tbody tr { cursor: pointer; border-bottom: 1px solid #eee; }
+tbody tr:hover { background: #f5f8fb; }
+tbody tr.selected { background: #dbe9f7; }
+tr.error td.status { color: #c0392b; font-weight: bold; }
+tr.redirect td.status { color: #8e44ad; }
+.num { text-align: right; }
+.tabs button { font: inherit; padding: 4px 12px; border: 1px solid #ccc; background: #f6f6f6; cursor: pointer; }
+.tabs button.active { background: #fff; border-bottom-color: #fff; font-weight: bold; }
+h3 { font-size: 13px; margin: 14px 0 4px; }
+dl { display: grid; grid-template-columns: max-content 1fr; gap: 2px 10px; margin: 0; }
+dt { color: #666; font-weight: bold; }
+dd { margin: 0; word-break: break-all; }
+pre { background: #f7f7f7; padding: 8px; white-space: pre-wrap; word-break: break-all; max-height: 60vh; overflow: auto; }
+img.body { max-width: 100%; border: 1px solid #ddd; }
+.note { color: #888; }
+</style>
+</head>
+<body>
+<header>
+  <h1>groxy</h1>
+  <input id="filter" placeholder="filter: text, method:POST, status:4xx, host:example.com, type:json" autofocus>
+  <label>HTTPS <select id="https"><option>proxy</option><option>mitm</option><option>reject</option></select></label>
+  <button id="clear">Clear</button>
+  <span id="status">connecting</span>
+</header>
+<main>
+  <div id="list">
+    <table>
+      <thead><tr><th class="num">#</th><th>Method</th><th>Status</th><th>Host</th><th>Path</th><th>Type</th><th class="num">Size</th><th class="num">Time</th></tr></thead>
+      <tbody id="flows"></tbody>
+    </table>
+  </div>
+  <div id="detail"></div>
+</main>
+<script>
+(function() {
+  "use strict";
+  var maxFlows = 5000;
+  var flows = [];
+  var lastSeq = 0;
+  var selected = null;
+  var selectedRow = null;
+  var tab = "request";
+  var $ = function(id) { return document.getElementById(id); };
+
+  function el(tag, attrs, children) {
+    var e = document.createElement(tag);
+    for (var k in attrs || {}) {
+      if (k === "text") { e.textContent = attrs[k]; } else { e.setAttribute(k, attrs[k]); }
+    }
+    (children || []).forEach(function(c) { if (c) { e.appendChild(c); } });
+    return e;
+  }
+
+  function parseURL(s) {
+    try { return new URL(s); } catch (e) { return { host: "", pathname: s, search: "" }; }
+  }
+
+  function mimeType(entry) {
+    return (entry.response.content.mimeType || "").split(";")[0];
+  }
+
+  function formatSize(n) {
+    if (n < 0) { return ""; }
+    if (n < 1024) { return n + " B"; }
+    if (n < 1024 * 1024) { return (n / 1024).toFixed(1) + " KB"; }
+    return (n / 1024 / 1024).toFixed(1) + " MB";
+  }
+
+  function matches(entry, filter) {
+    var u = parseURL(entry.request.url);
+    var tokens = filter.trim().toLowerCase().split(/\s+/).filter(Boolean);
+    return tokens.every(function(t) {
+      var i = t.indexOf(":");
+      var key = i > 0 ? t.slice(0, i) : "";
+      var value = t.slice(i + 1);
+      switch (key) {
+      case "method":
+        return entry.request.method.toLowerCase() === value;
+      case "status":
+        var status = String(entry.response.status);
+        return value.length === 3 && value.slice(1) === "xx" ? status[0] === value[0] : status === value;
+      case "host":
+        return u.host.toLowerCase().indexOf(value) >= 0;
+      case "type":
+        return mimeType(entry).toLowerCase().indexOf(value) >= 0;
+      default:
+        return (entry.request.method + " " + entry.request.url + " " + entry.response.status).toLowerCase().indexOf(t) >= 0;
+      }
+    });
+  }
+
+  function row(entry) {
+    var u = parseURL(entry.request.url);
+    var status = entry.response.status;
+    var tr = el("tr", {}, [
+      el("td", { "class": "num", text: String(entry._seq) }),
+      el("td", { text: entry.request.method }),
+      el("td", { "class": "status", text: status ? String(status) : "failed" }),
+      el("td", { text: u.host }),
+      el("td", { text: u.pathname + u.search, title: entry.request.url }),
+      el("td", { text: mimeType(entry) }),
+      el("td", { "class": "num", text: formatSize(entry.response.content.size) }),
+      el("td", { "class": "num", text: Math.round(entry.time) + " ms" })
+    ]);
+    if (!status || status >= 400) { tr.className = "error"; } else if (status >= 300) { tr.className = "redirect"; }
+    if (entry === selected) {
+      tr.className += " selected";
+      selectedRow = tr;
+    }
+    tr.onclick = function() { select(entry, tr); };
+    entry.$row = tr;
+    return tr;
+  }
+
+  function select(entry, tr) {
+    if (selectedRow) { selectedRow.classList.remove("selected"); }
+    selected = entry;
+    selectedRow = tr;
+    if (tr) { tr.classList.add("selected"); }
+    renderDetail();
+  }
+
+  // keepScroll keeps the list scrolled to the bottom while f changes rows.
+  function keepScroll(f) {
+    var list = $("list");
+    var atBottom = list.scrollTop + list.clientHeight >= list.scrollHeight - 5;
+    f();
+    if (atBottom) { list.scrollTop = list.scrollHeight; }
+  }
+
+  // render rebuilds all rows, which is needed only when the filter or the whole list is changed.
+  function render() {
+    var filter = $("filter").value;
+    var tbody = $("flows");
+    keepScroll(function() {
+      tbody.textContent = "";
+      selectedRow = null;
+      flows.forEach(function(entry) {
+        entry.$row = null;
+        if (matches(entry, filter)) { tbody.appendChild(row(entry)); }
+      });
+    });
+  }
+
+  // add appends rows of entries not shown yet, and removes rows of the oldest ones beyond maxFlows.
+  function add(entries) {
+    var filter = $("filter").value;
+    var tbody = $("flows");
+    keepScroll(function() {
+      entries.forEach(function(entry) {
+        if (entry._seq <= lastSeq) { return; }
+        lastSeq = entry._seq;
+        flows.push(entry);
+        if (matches(entry, filter)) { tbody.appendChild(row(entry)); }
+      });
+      flows.splice(0, Math.max(0, flows.length - maxFlows)).forEach(function(entry) {
+        if (entry.$row) { tbody.removeChild(entry.$row); }
+      });
+    });
+  }
+
+  function headers(list) {
+    if (!list || list.length === 0) { return el("p", { "class": "note", text: "no headers" }); }
+    var dl = el("dl");
+    list.slice().sort(function(a, b) { return a.name.localeCompare(b.name); }).forEach(function(h) {
+      dl.appendChild(el("dt", { text: h.name }));
+      dl.appendChild(el("dd", { text: h.value }));
+    });
+    return dl;
+  }
+
+  function decodeBase64(text) {
+    try { return atob(text); } catch (e) { return null; }
+  }
+
+  function body(text, encoding, mime, truncated, contentEncoding) {
+    var nodes = [];
+    if (truncated) { nodes.push(el("p", { "class": "note", text: "the body is truncated by the recorder." })); }
+    if (contentEncoding) { nodes.push(el("p", { "class": "note", text: "the body is still encoded with " + contentEncoding + "." })); }
+    if (!text) {
+      nodes.push(el("p", { "class": "note", text: "no body" }));
+      return nodes;
+    }
+    if (encoding === "base64") {
+      if (/^image\//.test(mime) && !truncated && !contentEncoding) {
+        nodes.push(el("img", { "class": "body", src: "data:" + mime + ";base64," + text }));
+      } else {
+        var raw = decodeBase64(text) || "";
+        nodes.push(el("p", { "class": "note", text: "binary data (" + raw.length + " bytes)" }));
+        var hex = [];
+        for (var i = 0; i < Math.min(raw.length, 1024); i++) {
+          hex.push(("0" + raw.charCodeAt(i).toString(16)).slice(-2));
+        }
+        nodes.push(el("pre", { text: hex.join(" ") + (raw.length > 1024 ? " ..." : "") }));
+      }
+      return nodes;
+    }
+    if (/json/.test(mime)) {
+      try { text = JSON.stringify(JSON.parse(text), null, 2); } catch (e) { /* show as it is */ }
+    }
+    nodes.push(el("pre", { text: text }));
+    return nodes;
+  }
+
+  function general(entry) {
+    var dl = el("dl");
+    var add = function(k, v) {
+      if (v) { dl.appendChild(el("dt", { text: k })); dl.appendChild(el("dd", { text: v })); }
+    };
+    add("URL", entry.request.url);
+    add("Method", entry.request.method);
+    add("Status", entry.response.status ? entry.response.status + " " + entry.response.statusText : "");
+    add("Started", new Date(entry.startedDateTime).toLocaleString());
+    add("Time", entry.time.toFixed(1) + " ms (wait " + entry.timings.wait.toFixed(1) + " ms)");
+    add("Client", entry._clientAddress);
+    add("User", entry._user);
+    if (entry._tls) { add("TLS", entry._tls.version + " " + entry._tls.cipherSuite + " " + (entry._tls.serverName || "")); }
+    add("Comment", entry.comment);
+    return dl;
+  }
+
+  function renderDetail() {
+    var d = $("detail");
+    d.textContent = "";
+    if (!selected) { d.className = ""; return; }
+    d.className = "open";
+    var tabs = el("div", { "class": "tabs" });
+    ["request", "response"].forEach(function(name) {
+      var b = el("button", { text: name[0].toUpperCase() + name.slice(1) });
+      if (name === tab) { b.className = "active"; }
+      b.onclick = function() { tab = name; renderDetail(); };
+      tabs.appendChild(b);
+    });
+    var close = el("button", { text: "Close" });
+    close.onclick = function() { select(null, null); };
+    tabs.appendChild(close);
+    d.appendChild(tabs);
+    d.appendChild(el("h3", { text: "General" }));
+    d.appendChild(general(selected));
+    if (tab === "request") {
+      var req = selected.request;
+      d.appendChild(el("h3", { text: "Request Headers" }));
+      d.appendChild(headers(req.headers));
+      d.appendChild(el("h3", { text: "Request Body" }));
+      var pd = req.postData || {};
+      body(pd.text, pd._encoding, pd.mimeType || "", pd._truncated, "").forEach(function(n) { d.appendChild(n); });
+    } else {
+      var resp = selected.response;
+      d.appendChild(el("h3", { text: "Response Headers" }));
+      d.appendChild(headers(resp.headers));
+      d.appendChild(el("h3", { text: "Response Body" }));
+      var c = resp.content;
+      body(c.text, c.encoding, mimeType(selected), c._truncated, c._contentEncoding).forEach(function(n) { d.appendChild(n); });
+    }
+  }
+
+  function request(method, path, data) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, path);
+    if (method === "POST" || method === "PUT") { xhr.setRequestHeader("Content-Type", "application/json"); }
+    return new Promise(function(resolve, reject) {
+      xhr.onload = function() {
+        if (xhr.status >= 400) { reject(new Error(xhr.responseText)); return; }
+        resolve(xhr.responseText ? JSON.parse(xhr.responseText) : null);
+      };
+      xhr.onerror = reject;
+      xhr.send(data ? JSON.stringify(data) : null);
+    });
+  }
+
+  $("filter").oninput = render;
+  $("clear").onclick = function() {
+    request("DELETE", "/api/flows").then(function() {
+      flows = [];
+      selected = null;
+      render();
+      renderDetail();
+    });
+  };
+  $("https").onchange = function() {
+    request("PUT", "/api/https", { action: $("https").value });
+  };
+  request("GET", "/api/config").then(function(cfg) { $("https").value = cfg.httpsAction; });
+
+  // events received while flows are loaded are added after them, and duplicated ones are skipped by _seq.
+  var pending = [];
+  function load() {
+    pending = pending || [];
+    request("GET", "/api/flows").then(function(entries) {
+      add(entries || []);
+      add(pending);
+      pending = null;
+    }, function(err) {
+      pending = null;
+      $("status").textContent = "error";
+      $("flows").appendChild(el("tr", {}, [el("td", { colspan: "8", text: "failed to load flows: " + err.message })]));
+    });
+  }
+
+  var lost = false;
+  var events = new EventSource("/api/events");
+  events.onopen = function() {
+    $("status").textContent = "live";
+    // flows recorded while disconnected are loaded again.
+    if (lost) {
+      lost = false;
+      load();
+    }
+  };
+  events.onerror = function() {
+    lost = true;
+    $("status").textContent = "reconnecting";
+  };
+  events.addEventListener("flow", function(e) {
+    var entry = JSON.parse(e.data);
+    if (pending) { pending.push(entry); } else { add([entry]); }
+  });
+  load();
+})();
+</script>
+</body>
+</html>
+`